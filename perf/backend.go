@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"embed"
 	"encoding/json"
 	"errors"
@@ -13,6 +14,7 @@ import (
 	"net/http"
 	"os"
 	"path"
+	"strconv"
 	"syscall"
 	"time"
 
@@ -22,39 +24,95 @@ import (
 //go:embed *.html
 var BackendFS embed.FS
 
-func (c *ServeBackendCmd) Run(p *ProgramCtx) error {
-	log.SetPrefix(fmt.Sprintf("[c %v %v %s] ", os.Getpid(), mustResolveHostIP(), c.Name))
-
-	var t = mustParseTrafficType(string(c.TrafficType))
-
-	listenAddress := c.ListenAddress
+// backendListenAddresses returns the address a backend should bind
+// to and the address it should advertise to the metadata server.
+func backendListenAddresses(listenAddress string) (string, string) {
 	if listenAddress == "" || listenAddress == "127.0.0.1" || listenAddress == "::1" {
 		listenAddress = "0.0.0.0"
 	}
+	if listenAddress == "0.0.0.0" {
+		return listenAddress, mustResolveHostIP()
+	}
+	return listenAddress, listenAddress
+}
+
+// listenReplicas binds a listener on an ephemeral port for each of
+// a backend's replicas.
+func listenReplicas(listenAddress string, replicas int) ([]net.Listener, error) {
+	var listeners []net.Listener
+
+	for i := 0; i < replicas; i++ {
+		listener, err := net.Listen("tcp", fmt.Sprintf("%v:0", listenAddress))
+		if err != nil {
+			for _, l := range listeners {
+				_ = l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+	}
+
+	return listeners, nil
+}
+
+func replicaEndpoints(advertiseAddress string, listeners []net.Listener) []Endpoint {
+	var endpoints []Endpoint
+
+	for _, listener := range listeners {
+		endpoints = append(endpoints, Endpoint{
+			ListenAddress: advertiseAddress,
+			Port:          listener.Addr().(*net.TCPAddr).Port,
+		})
+	}
+
+	return endpoints
+}
+
+// BackendEndpointHeader identifies the endpoint that served a
+// response as <backend name>/<replica>.
+const BackendEndpointHeader = "X-Backend-Endpoint"
 
-	listener, err := net.Listen("tcp", fmt.Sprintf("%v:0", listenAddress))
+func backendEndpointID(name string, replica int) string {
+	return fmt.Sprintf("%s/%d", name, replica)
+}
+
+// serveBackend serves BackendFS, synthetic responses at
+// ResponsePath and health checks at HealthCheckPath on listener,
+// injecting faults, until ctx is cancelled. TLS is only terminated
+// for the traffic types that expect the backend to speak TLS.
+func serveBackend(ctx context.Context, listener net.Listener, backend Backend, replica int, faults *backendFaults, tlsConfig *tls.Config) error {
+	spec, err := lookupTrafficType(backend.TrafficType)
 	if err != nil {
 		return err
 	}
 
-	certs := certStore(path.Join(p.Globals.OutputDir, "certs"))
+	mux := http.NewServeMux()
+	mux.Handle("/", http.FileServer(http.FS(BackendFS)))
+	mux.HandleFunc(ResponsePath, serveResponse)
+	mux.HandleFunc(HealthCheckPath, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok\n")
+	})
+
+	endpointID := backendEndpointID(backend.Name, replica)
+	handler := faults.handler(replica, mux)
 
 	httpServer := &http.Server{
-		Handler:      http.FileServer(http.FS(BackendFS)),
-		Addr:         fmt.Sprintf("%v:%v", listenAddress, p.Port),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(BackendEndpointHeader, endpointID)
+			handler.ServeHTTP(w, r)
+		}),
 		ReadTimeout:  15 * time.Second,
 		WriteTimeout: 15 * time.Second,
+		TLSConfig:    tlsConfig,
 	}
 
-	g, gCtx := errgroup.WithContext(p.Context)
+	g, gCtx := errgroup.WithContext(ctx)
 
 	g.Go(func() error {
-		switch t {
-		case HTTPTraffic, EdgeTraffic:
+		if spec.BackendTLS == BackendPlain {
 			return httpServer.Serve(listener)
-		default:
-			return httpServer.ServeTLS(listener, certs.DomainFile, certs.TLSKeyFile)
 		}
+		return httpServer.ServeTLS(listener, "", "")
 	})
 
 	g.Go(func() error {
@@ -65,20 +123,88 @@ func (c *ServeBackendCmd) Run(p *ProgramCtx) error {
 		return httpServer.Shutdown(shutdownCtx)
 	})
 
-	if listenAddress == "0.0.0.0" {
-		listenAddress = mustResolveHostIP()
+	if err := g.Wait(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return nil
+}
+
+func (c *ServeBackendCmd) Run(p *ProgramCtx) error {
+	log.SetPrefix(fmt.Sprintf("[c %v %v %s] ", os.Getpid(), mustResolveHostIP(), c.Name))
+
+	if _, err := lookupTrafficType(c.TrafficType); err != nil {
+		return err
+	}
+
+	listenAddress, advertiseAddress := backendListenAddresses(c.ListenAddress)
+
+	listeners, err := listenReplicas(listenAddress, c.Replicas)
+	if err != nil {
+		return err
+	}
+
+	certs := certStore(path.Join(p.Globals.OutputDir, "certs"))
+
+	cert, err := tls.LoadX509KeyPair(certs.DomainFile, certs.TLSKeyFile)
+	if err != nil {
+		return err
+	}
+
+	g, gCtx := errgroup.WithContext(p.Context)
+
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	backend := Backend{
+		Name:        c.Name,
+		TrafficType: c.TrafficType,
+	}
+
+	endpoints := replicaEndpoints(advertiseAddress, listeners)
+	faults, listeners := newBackendFaults(listeners)
+
+	for i, listener := range listeners {
+		i, listener := i, listener
+		g.Go(func() error {
+			return serveBackend(gCtx, listener, backend, i, faults, tlsConfig)
+		})
+	}
+
+	// The metadata server sends faults to the control endpoint,
+	// which is apart from the replicas' listeners so that it
+	// stays reachable while they refuse connections or hang.
+	controlListener, err := net.Listen("tcp", net.JoinHostPort(listenAddress, "0"))
+	if err != nil {
+		return err
+	}
+
+	controlServer := &http.Server{
+		Handler:      http.HandlerFunc(faults.serveControl),
+		ReadTimeout:  15 * time.Second,
+		WriteTimeout: 15 * time.Second,
 	}
 
+	g.Go(func() error {
+		if err := controlServer.Serve(controlListener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+		return nil
+	})
+
+	g.Go(func() error {
+		<-gCtx.Done()
+		return controlServer.Close()
+	})
+
 	boundBackend := BoundBackend{
-		Backend: Backend{
-			Name:        c.Name,
-			TrafficType: t,
-		},
-		ListenAddress: listenAddress,
-		Port:          listener.Addr().(*net.TCPAddr).Port,
+		Backend:   backend,
+		Endpoints: endpoints,
 	}
 
-	jsonValue, err := json.Marshal(boundBackend)
+	jsonValue, err := json.Marshal(BackendRegistration{
+		BoundBackend: boundBackend,
+		ControlURL:   fmt.Sprintf("http://%s/faults", net.JoinHostPort(advertiseAddress, strconv.Itoa(controlListener.Addr().(*net.TCPAddr).Port))),
+	})
 	if err != nil {
 		return err
 	}
@@ -127,9 +253,5 @@ func (c *ServeBackendCmd) Run(p *ProgramCtx) error {
 		return fmt.Errorf("registration failed for %+v; Status=%v", boundBackend, resp.Status)
 	}
 
-	if err := g.Wait(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-		return err
-	}
-
-	return nil
+	return g.Wait()
 }
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,7 +11,6 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
-	"os/signal"
 	"path"
 	"runtime/debug"
 	"sync"
@@ -25,24 +25,124 @@ type Backend struct {
 	TrafficType TrafficType `json:"traffic_type"`
 }
 
+// Endpoint is one replica of a backend.
+type Endpoint struct {
+	ListenAddress string `json:"listen_address"`
+	Port          int    `json:"port"`
+}
+
+// BoundBackend is a route and the endpoints serving it.
 type BoundBackend struct {
 	Backend
 
-	ListenAddress string `json:"listen_address"`
-	Port          int    `json:"port"`
+	Endpoints []Endpoint `json:"endpoints"`
 }
 
 type BackendsByTrafficType map[TrafficType][]Backend
 type BoundBackendsByTrafficType map[TrafficType][]BoundBackend
 
-func (c *ServeBackendsCmd) spawnBackend(ctx context.Context, backend Backend) error {
+// AddBackendsRequest is the body of a POST to /backends/add.
+// Replicas defaults to serve-backends' --replicas.
+type AddBackendsRequest struct {
+	TrafficType TrafficType `json:"traffic_type"`
+	Count       int         `json:"count"`
+	Replicas    int         `json:"replicas,omitempty"`
+}
+
+// RemoveBackendsRequest is the body of a POST to /backends/remove.
+// Either Names, or TrafficType and Count (which removes the most
+// recently added backends of that type), must be set.
+type RemoveBackendsRequest struct {
+	Names       []string    `json:"names,omitempty"`
+	TrafficType TrafficType `json:"traffic_type,omitempty"`
+	Count       int         `json:"count,omitempty"`
+}
+
+// backendCertificates is the certificate bundle served to backends
+// and proxies. The leaf certificate is reissued, signed by the same
+// root CA, whenever new backend names need to be covered.
+type backendCertificates struct {
+	mu     sync.Mutex
+	dir    string
+	bundle *Certificates
+	leaf   *tls.Certificate
+}
+
+func (c *backendCertificates) issue(alternateNames []string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var (
+		bundle *Certificates
+		err    error
+	)
+
+	if c.bundle == nil {
+		bundle, err = CreateTLSCerts(time.Now(), time.Now().AddDate(1, 0, 0), alternateNames...)
+	} else {
+		bundle, err = ReissueTLSCerts(c.bundle, time.Now(), time.Now().AddDate(1, 0, 0), alternateNames...)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to generate certificates: %v", err)
+	}
+
+	leaf, err := tls.X509KeyPair([]byte(bundle.LeafCertPEM), []byte(bundle.LeafKeyPEM))
+	if err != nil {
+		return err
+	}
+
+	if _, err := writeCertificates(c.dir, bundle); err != nil {
+		return err
+	}
+
+	c.bundle = bundle
+	c.leaf = &leaf
+	return nil
+}
+
+func (c *backendCertificates) current() *Certificates {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.bundle
+}
+
+func (c *backendCertificates) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.leaf, nil
+}
+
+// backendServer starts and stops the backends in the registry,
+// either as goroutines or as child processes.
+type backendServer struct {
+	*ServeBackendsCmd
+
+	ctx              context.Context
+	g                *errgroup.Group
+	p                *ProgramCtx
+	registry         *backendRegistry
+	certs            *backendCertificates
+	tlsConfig        *tls.Config
+	listenAddress    string
+	advertiseAddress string
+	died             chan error
+
+	mu       sync.Mutex
+	stops    map[string]func()
+	controls map[string]func(EndpointFaults) error
+}
+
+func (s *backendServer) spawnBackend(backend Backend, replicas int) (func(), error) {
 	newArgs := []string{
 		"serve-backend",
 		fmt.Sprintf("--name=%s", backend.Name),
 		fmt.Sprintf("--traffic-type=%s", backend.TrafficType),
+		fmt.Sprintf("--replicas=%v", replicas),
+		fmt.Sprintf("--port=%v", s.p.Port),
+		fmt.Sprintf("--output-dir=%s", s.p.OutputDir),
 	}
-	if c.ListenAddress != "127.0.0.1" {
-		newArgs = append(newArgs, fmt.Sprintf("--listen-address=%s", c.ListenAddress))
+	if s.ListenAddress != "127.0.0.1" {
+		newArgs = append(newArgs, fmt.Sprintf("--listen-address=%s", s.ListenAddress))
 	}
 	cmd := exec.Command(os.Args[0], newArgs...)
 	cmd.Stdin = os.Stdin
@@ -52,12 +152,266 @@ func (c *ServeBackendsCmd) spawnBackend(ctx context.Context, backend Backend) er
 		Pdeathsig: syscall.SIGTERM,
 	}
 	if err := cmd.Start(); err != nil {
-		return err
+		return nil, err
+	}
+	go func() {
+		err := cmd.Wait()
+		s.mu.Lock()
+		_, running := s.stops[backend.Name]
+		s.mu.Unlock()
+		if running && s.ctx.Err() == nil {
+			select {
+			case s.died <- fmt.Errorf("backend %s died: %v", backend.Name, err):
+			default:
+			}
+		}
+	}()
+	return func() {
+		_ = cmd.Process.Signal(syscall.SIGTERM)
+	}, nil
+}
+
+// serveInProcess binds a listener for each replica of backend and
+// serves them as goroutines. The backend is registered directly,
+// avoiding the /register round trip.
+func (s *backendServer) serveInProcess(backend Backend, replicas int) (func(), error) {
+	listeners, err := listenReplicas(s.listenAddress, replicas)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(s.ctx)
+
+	endpoints := replicaEndpoints(s.advertiseAddress, listeners)
+	faults, listeners := newBackendFaults(listeners)
+
+	for i, listener := range listeners {
+		i, listener := i, listener
+		s.g.Go(func() error {
+			return serveBackend(ctx, listener, backend, i, faults, s.tlsConfig)
+		})
+	}
+
+	s.mu.Lock()
+	s.controls[backend.Name] = faults.set
+	s.mu.Unlock()
+
+	if err := s.registry.register(BoundBackend{
+		Backend:   backend,
+		Endpoints: endpoints,
+	}); err != nil {
+		s.mu.Lock()
+		delete(s.controls, backend.Name)
+		s.mu.Unlock()
+		cancel()
+		return nil, err
+	}
+
+	return cancel, nil
+}
+
+func (s *backendServer) start(backends []Backend, replicas int) error {
+	for _, backend := range backends {
+		var (
+			stop func()
+			err  error
+		)
+		if s.InProcess {
+			stop, err = s.serveInProcess(backend, replicas)
+		} else {
+			stop, err = s.spawnBackend(backend, replicas)
+		}
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		s.stops[backend.Name] = stop
+		s.mu.Unlock()
 	}
-	go cmd.Wait()
 	return nil
 }
 
+func (s *backendServer) stop(name string) {
+	s.mu.Lock()
+	stop, ok := s.stops[name]
+	delete(s.stops, name)
+	delete(s.controls, name)
+	s.mu.Unlock()
+	if ok {
+		stop()
+	}
+}
+
+// add starts n new backends of traffic type t, each with replicas
+// endpoints, reissuing the certificates to cover their names, and
+// waits for them to register.
+func (s *backendServer) add(t TrafficType, n, replicas int) ([]BoundBackend, error) {
+	backends := s.registry.allocate(t, n)
+
+	// release undoes the allocation, so that a failed add leaves
+	// no phantom backends in the topology or the certificates.
+	release := func(err error) ([]BoundBackend, error) {
+		for _, b := range backends {
+			s.registry.remove(b.Name)
+			s.stop(b.Name)
+		}
+		if err := s.certs.issue(s.registry.names()); err != nil {
+			log.Printf("reissuing certificates: %v", err)
+		}
+		return nil, err
+	}
+
+	if err := s.certs.issue(s.registry.names()); err != nil {
+		return release(err)
+	}
+
+	if err := s.start(backends, replicas); err != nil {
+		return release(err)
+	}
+
+	if err := s.registry.waitForRegistration(s.ctx, backends, 15*time.Second); err != nil {
+		return release(err)
+	}
+
+	var result []BoundBackend
+	for _, b := range s.registry.boundBackendsByTrafficType()[t] {
+		for _, added := range backends {
+			if b.Name == added.Name {
+				result = append(result, b)
+			}
+		}
+	}
+
+	log.Printf("added %d %s backend(s)", len(result), t)
+	return result, nil
+}
+
+func (s *backendServer) remove(names []string) []Backend {
+	var removed []Backend
+
+	for _, name := range names {
+		if b, ok := s.registry.remove(name); ok {
+			s.stop(name)
+			removed = append(removed, b)
+		}
+	}
+
+	log.Printf("removed %d backend(s)", len(removed))
+	return removed
+}
+
+// injectFaults sends ef to each of the named backends' control
+// endpoints. It returns the backends the faults were set on.
+func (s *backendServer) injectFaults(names []string, ef EndpointFaults) ([]string, error) {
+	var g errgroup.Group
+
+	s.mu.Lock()
+	for _, name := range names {
+		control, ok := s.controls[name]
+		if !ok {
+			s.mu.Unlock()
+			return nil, fmt.Errorf("unknown backend %q", name)
+		}
+		name := name
+		g.Go(func() error {
+			if err := control(ef); err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			return nil
+		})
+	}
+	s.mu.Unlock()
+
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	log.Printf("set faults %+v on %d backend(s)", ef, len(names))
+	return names, nil
+}
+
+// watch streams the topology as Server-Sent Events: a "snapshot"
+// event with the current TopologySnapshot followed by an "added" or
+// "removed" TopologyEvent for every change.
+func (s *backendServer) watch(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+
+	// The stream outlives the server's WriteTimeout.
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	snapshot, events, cancel := s.registry.watch()
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	send := func(event string, v interface{}) error {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+
+	if err := send("snapshot", snapshot); err != nil {
+		return
+	}
+
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				log.Printf("dropping slow watcher %v", r.RemoteAddr)
+				return
+			}
+			if err := send(event.Type, event); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := io.WriteString(w, string(data)); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+}
+
+func decodeJSONRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if r.Method != http.MethodPost {
+		http.Error(w, r.Method, http.StatusBadRequest)
+		return false
+	}
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func isTrafficType(t TrafficType) bool {
+	_, err := lookupTrafficType(t)
+	return err == nil
+}
+
 func (c *ServeBackendsCmd) Run(p *ProgramCtx) error {
 	log.SetPrefix(fmt.Sprintf("[P %v] %v ", os.Getpid(), mustResolveHostIP()))
 
@@ -65,14 +419,6 @@ func (c *ServeBackendsCmd) Run(p *ProgramCtx) error {
 		return err
 	}
 
-	var (
-		backendsByTrafficType = BackendsByTrafficType{}
-		backendsReady         = make(chan bool)
-		backendsRegistered    = 0
-		boundBackends         sync.Map
-		registerHandlerLock   sync.Mutex
-	)
-
 	mux := http.NewServeMux()
 
 	httpServer := &http.Server{
@@ -83,41 +429,60 @@ func (c *ServeBackendsCmd) Run(p *ProgramCtx) error {
 	}
 
 	g, gCtx := errgroup.WithContext(p.Context)
-	chldSignalCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGCHLD)
-	defer stop()
+
+	certs := &backendCertificates{dir: path.Join(p.OutputDir, "certs")}
+	listenAddress, advertiseAddress := backendListenAddresses(c.ListenAddress)
+
+	server := &backendServer{
+		ServeBackendsCmd: c,
+		ctx:              gCtx,
+		g:                g,
+		p:                p,
+		registry:         newBackendRegistry(p.HostPrefix),
+		certs:            certs,
+		tlsConfig:        &tls.Config{GetCertificate: certs.getCertificate},
+		listenAddress:    listenAddress,
+		advertiseAddress: advertiseAddress,
+		died:             make(chan error, 1),
+		stops:            map[string]func(){},
+		controls:         map[string]func(EndpointFaults) error{},
+	}
 
 	g.Go(func() error {
 		select {
-		case <-chldSignalCtx.Done():
-			return fmt.Errorf("a backend died")
+		case err := <-server.died:
+			return err
 		case <-gCtx.Done():
 			return nil
 		}
 	})
 
 	mux.HandleFunc("/register", func(w http.ResponseWriter, r *http.Request) {
-		registerHandlerLock.Lock()
-		defer registerHandlerLock.Unlock()
-		if backendsRegistered == len(backendsByTrafficType)*p.Nbackends {
-			http.Error(w, "unexpected registration", http.StatusBadRequest)
+		var registration BackendRegistration
+		if !decodeJSONRequest(w, r, &registration) {
 			return
 		}
-		if r.Method != http.MethodPost {
-			http.Error(w, r.Method, http.StatusBadRequest)
-			return
+		// The control is in place before the backend appears
+		// in the topology, and is restored if it does not.
+		server.mu.Lock()
+		previous, hadControl := server.controls[registration.Name]
+		if registration.ControlURL != "" {
+			server.controls[registration.Name] = func(ef EndpointFaults) error {
+				return postJSON(registration.ControlURL, ef)
+			}
 		}
-		decoder := json.NewDecoder(r.Body)
-		decoder.DisallowUnknownFields()
-		var boundBackend BoundBackend
-		if err := decoder.Decode(&boundBackend); err != nil {
+		server.mu.Unlock()
+		if err := server.registry.register(registration.BoundBackend); err != nil {
+			server.mu.Lock()
+			if hadControl {
+				server.controls[registration.Name] = previous
+			} else {
+				delete(server.controls, registration.Name)
+			}
+			server.mu.Unlock()
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		boundBackends.Store(boundBackend.Name, boundBackend)
-		backendsRegistered += 1
-		if backendsRegistered == len(backendsByTrafficType)*p.Nbackends {
-			backendsReady <- true
-		}
 	})
 
 	g.Go(func() error {
@@ -138,120 +503,133 @@ func (c *ServeBackendsCmd) Run(p *ProgramCtx) error {
 		return httpServer.Shutdown(shutdownCtx)
 	})
 
-	var subjectAlternateNames []string
+	if c.Replicas < 1 {
+		return fmt.Errorf("invalid number of replicas: %v", c.Replicas)
+	}
+
+	var backends []Backend
 
 	for _, t := range AllTrafficTypes {
-		for i := 0; i < p.Nbackends; i++ {
-			backend := Backend{
-				Name:        fmt.Sprintf("%s-%v-%v", p.HostPrefix, t, i),
-				TrafficType: t,
-			}
-			backendsByTrafficType[t] = append(backendsByTrafficType[t], backend)
-			subjectAlternateNames = append(subjectAlternateNames, backend.Name)
-		}
+		backends = append(backends, server.registry.allocate(t, p.Nbackends)...)
 	}
 
 	// Create certificates after we know all the backend names.
-	certBundle, err := CreateTLSCerts(time.Now(), time.Now().AddDate(1, 0, 0), subjectAlternateNames...)
-	if err != nil {
-		return fmt.Errorf("failed to generate certificates: %v", err)
-	}
-
-	if _, err := writeCertificates(path.Join(p.OutputDir, "certs"), certBundle); err != nil {
+	if err := certs.issue(server.registry.names()); err != nil {
 		return err
 	}
 
-	if len(backendsByTrafficType)*p.Nbackends >= 10000 {
-		// 10,000 is the default for the runtime.
-		debug.SetMaxThreads(len(backendsByTrafficType)*p.Nbackends + p.Nbackends)
-	}
-
-	for t, backends := range backendsByTrafficType {
-		log.Printf("starting %d %s backend(s)\n", p.Nbackends, t)
-		for _, backend := range backends {
-			if err := c.spawnBackend(p.Context, backend); err != nil {
-				return err
-			}
+	if c.InProcess {
+		log.Printf("starting %d backend(s) with %d replica(s) in-process\n", len(backends), c.Replicas)
+	} else {
+		if len(backends) >= 10000 {
+			// 10,000 is the default for the runtime.
+			debug.SetMaxThreads(len(backends) + p.Nbackends)
+		}
+		for _, t := range AllTrafficTypes {
+			log.Printf("starting %d %s backend(s) with %d replica(s)\n", p.Nbackends, t, c.Replicas)
 		}
 	}
 
-	select {
-	case <-backendsReady:
-		log.Printf("%d backend(s) processes registered", len(AllTrafficTypes)*p.Nbackends)
-	case <-gCtx.Done():
-		return nil
-	case <-time.After(15 * time.Second):
-		return fmt.Errorf("timeout waiting for backends to register")
+	if err := server.start(backends, c.Replicas); err != nil {
+		return err
 	}
 
-	printBackendsForType := func(w io.Writer, t TrafficType) error {
-		for _, b := range backendsByTrafficType[t] {
-			obj, ok := boundBackends.Load(b.Name)
-			if !ok {
-				panic("missing backend registration for" + b.Name)
-			}
-			boundBackend, ok := obj.(BoundBackend)
-			if !ok {
-				panic(fmt.Sprintf("unexpected type: %T", obj))
-			}
-			if _, err := io.WriteString(w, fmt.Sprintf("%v %v %v\n", b.Name, boundBackend.ListenAddress, boundBackend.Port)); err != nil {
-				return err
-			}
+	if err := server.registry.waitForRegistration(gCtx, backends, 15*time.Second); err != nil {
+		if gCtx.Err() != nil {
+			return g.Wait()
 		}
-		return nil
+		return err
 	}
 
+	log.Printf("%d backend(s) registered", len(backends))
+
 	mux.HandleFunc("/certs", func(w http.ResponseWriter, r *http.Request) {
-		data, err := json.MarshalIndent(certBundle, "", "  ")
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
-		if _, err := io.WriteString(w, string(data)); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
+		writeJSON(w, certs.current())
 	})
 
 	mux.HandleFunc("/backends", func(w http.ResponseWriter, r *http.Request) {
+		boundBackendsByTrafficType := server.registry.boundBackendsByTrafficType()
+
 		if _, ok := r.URL.Query()["json"]; !ok {
 			for _, t := range AllTrafficTypes {
-				if err := printBackendsForType(w, t); err != nil {
-					http.Error(w, err.Error(), http.StatusBadRequest)
+				for _, b := range boundBackendsByTrafficType[t] {
+					for _, e := range b.Endpoints {
+						if _, err := io.WriteString(w, fmt.Sprintf("%v %v %v\n", b.Name, e.ListenAddress, e.Port)); err != nil {
+							http.Error(w, err.Error(), http.StatusBadRequest)
+							return
+						}
+					}
 				}
 			}
 			return
 		}
 
-		var boundBackendsByTrafficType = BoundBackendsByTrafficType{}
+		writeJSON(w, boundBackendsByTrafficType)
+	})
 
-		for _, t := range AllTrafficTypes {
-			for _, b := range backendsByTrafficType[t] {
-				obj, ok := boundBackends.Load(b.Name)
-				if !ok {
-					panic("missing registration for" + b.Name)
-				}
-				boundBackend, ok := obj.(BoundBackend)
-				if !ok {
-					panic(fmt.Sprintf("unexpected type: %T", obj))
-				}
-				boundBackendsByTrafficType[t] = append(boundBackendsByTrafficType[t],
-					BoundBackend{
-						Backend:       b,
-						Port:          boundBackend.Port,
-						ListenAddress: boundBackend.ListenAddress,
-					})
-			}
+	mux.HandleFunc("/backends/watch", func(w http.ResponseWriter, r *http.Request) {
+		server.watch(w, r)
+	})
+
+	mux.HandleFunc("/backends/add", func(w http.ResponseWriter, r *http.Request) {
+		var request AddBackendsRequest
+		if !decodeJSONRequest(w, r, &request) {
+			return
+		}
+		if request.Replicas == 0 {
+			request.Replicas = c.Replicas
 		}
-		data, err := json.MarshalIndent(boundBackendsByTrafficType, "", "  ")
+		if !isTrafficType(request.TrafficType) || request.Count < 1 || request.Replicas < 1 {
+			http.Error(w, fmt.Sprintf("invalid request: %+v", request), http.StatusBadRequest)
+			return
+		}
+		added, err := server.add(request.TrafficType, request.Count, request.Replicas)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, added)
+	})
+
+	mux.HandleFunc("/backends/remove", func(w http.ResponseWriter, r *http.Request) {
+		var request RemoveBackendsRequest
+		if !decodeJSONRequest(w, r, &request) {
+			return
+		}
+		names := request.Names
+		if len(names) == 0 {
+			if !isTrafficType(request.TrafficType) || request.Count < 1 {
+				http.Error(w, fmt.Sprintf("invalid request: %+v", request), http.StatusBadRequest)
+				return
+			}
+			for _, b := range server.registry.newest(request.TrafficType, request.Count) {
+				names = append(names, b.Name)
+			}
+		}
+		writeJSON(w, server.remove(names))
+	})
+
+	mux.HandleFunc("/backends/faults", func(w http.ResponseWriter, r *http.Request) {
+		var request InjectFaultsRequest
+		if !decodeJSONRequest(w, r, &request) {
 			return
 		}
-		if _, err := io.WriteString(w, string(data)); err != nil {
+		names := request.Names
+		if len(names) == 0 {
+			if !isTrafficType(request.TrafficType) {
+				http.Error(w, fmt.Sprintf("invalid request: %+v", request), http.StatusBadRequest)
+				return
+			}
+			for _, b := range server.registry.boundBackendsByTrafficType()[request.TrafficType] {
+				names = append(names, b.Name)
+			}
+		}
+		injected, err := server.injectFaults(names, request.EndpointFaults)
+		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		writeJSON(w, injected)
 	})
 
 	log.Printf("metadata server available at http://%s:%v/backends", mustResolveHostname(), p.Port)
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"reflect"
+	"testing"
+
+	"golang.org/x/sync/errgroup"
+)
+
+func TestBackendServerAddReleasesOnError(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	g, gCtx := errgroup.WithContext(ctx)
+	defer g.Wait()
+	defer cancel()
+
+	certs := &backendCertificates{dir: t.TempDir()}
+	server := &backendServer{
+		ServeBackendsCmd: &ServeBackendsCmd{InProcess: true},
+		ctx:              gCtx,
+		g:                g,
+		p:                &ProgramCtx{Context: gCtx},
+		registry:         newBackendRegistry("test"),
+		certs:            certs,
+		tlsConfig:        &tls.Config{GetCertificate: certs.getCertificate},
+		listenAddress:    "127.0.0.1",
+		advertiseAddress: "127.0.0.1",
+		stops:            map[string]func(){},
+		controls:         map[string]func(EndpointFaults) error{},
+	}
+
+	if _, err := server.add(HTTPTraffic, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	server.listenAddress = "192.0.2.1" // not a local address
+	if _, err := server.add(HTTPTraffic, 2, 1); err == nil {
+		t.Fatal("expected the add to fail")
+	}
+
+	expected := []string{"test-http-0"}
+	if names := server.registry.names(); !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected %v to be allocated, got %v", expected, names)
+	}
+	if len(server.stops) != 1 || len(server.controls) != 1 {
+		t.Errorf("expected only test-http-0 to be running, got %v %v", server.stops, server.controls)
+	}
+
+	block, _ := pem.Decode([]byte(certs.current().LeafCertPEM))
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range leaf.DNSNames {
+		if name != "test-http-0" && name != "localhost" {
+			t.Errorf("unexpected certificate name %q", name)
+		}
+	}
+}
+
+func TestBackendServerServeInProcessRegistrationError(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	g, gCtx := errgroup.WithContext(ctx)
+	defer g.Wait()
+	defer cancel()
+
+	server := &backendServer{
+		ServeBackendsCmd: &ServeBackendsCmd{InProcess: true},
+		ctx:              gCtx,
+		g:                g,
+		registry:         newBackendRegistry("test"),
+		listenAddress:    "127.0.0.1",
+		advertiseAddress: "127.0.0.1",
+		stops:            map[string]func(){},
+		controls:         map[string]func(EndpointFaults) error{},
+	}
+
+	// Never allocated, so it cannot register.
+	if _, err := server.serveInProcess(Backend{Name: "test-http-0", TrafficType: HTTPTraffic}, 1); err == nil {
+		t.Fatal("expected registration to fail")
+	}
+	if len(server.controls) != 0 {
+		t.Errorf("expected no fault controls, got %v", server.controls)
+	}
+}
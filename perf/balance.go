@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// balanceReport counts, per host, the responses served by each of
+// its endpoints as identified by BackendEndpointHeader.
+type balanceReport struct {
+	byHost map[string]map[string]int
+
+	// endpoints is the number of endpoints of each host, so that
+	// those that served no requests are counted too.
+	endpoints map[string]int
+}
+
+// newBalanceReport returns an empty report of the endpoints of
+// backendsByTrafficType.
+func newBalanceReport(backendsByTrafficType BoundBackendsByTrafficType) *balanceReport {
+	r := &balanceReport{
+		byHost:    map[string]map[string]int{},
+		endpoints: map[string]int{},
+	}
+	for _, backends := range backendsByTrafficType {
+		for _, b := range backends {
+			r.endpoints[b.Name] = len(b.Endpoints)
+		}
+	}
+	return r
+}
+
+func (r *balanceReport) record(host, endpoint string) {
+	if endpoint == "" {
+		return
+	}
+	if _, ok := r.byHost[host]; !ok {
+		r.byHost[host] = map[string]int{}
+	}
+	r.byHost[host][endpoint] += 1
+}
+
+// coefficientOfVariation is the population standard deviation of
+// counts relative to their mean; 0 is a perfectly even distribution.
+func coefficientOfVariation(counts []float64) float64 {
+	m := mean(counts)
+	if m == 0 {
+		return 0
+	}
+	sum := 0.0
+	for _, c := range counts {
+		sum += (c - m) * (c - m)
+	}
+	return math.Sqrt(sum/float64(len(counts))) / m
+}
+
+// hostEndpoints returns the endpoints of host: each of its known
+// endpoints in order, then any others that served requests.
+func (r *balanceReport) hostEndpoints(host string) []string {
+	var endpoints []string
+	known := map[string]bool{}
+	for i := 0; i < r.endpoints[host]; i++ {
+		endpoint := backendEndpointID(host, i)
+		endpoints = append(endpoints, endpoint)
+		known[endpoint] = true
+	}
+
+	var others []string
+	for endpoint := range r.byHost[host] {
+		if !known[endpoint] {
+			others = append(others, endpoint)
+		}
+	}
+	sort.Strings(others)
+
+	return append(endpoints, others...)
+}
+
+// write prints the distribution of each host's requests across its
+// endpoints. Endpoints that served no requests are included, as
+// zero, if the host's endpoints are known.
+func (r *balanceReport) write(w io.Writer) error {
+	if len(r.byHost) == 0 {
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+
+	if _, err := fmt.Fprintln(tw, "distribution\trequests\tendpoints\tcv\tcounts"); err != nil {
+		return err
+	}
+
+	hosts := make([]string, 0, len(r.byHost))
+	for host := range r.byHost {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	for _, host := range hosts {
+		endpoints := r.hostEndpoints(host)
+
+		var (
+			total  int
+			counts []float64
+			fields []string
+		)
+		for _, endpoint := range endpoints {
+			n := r.byHost[host][endpoint]
+			total += n
+			counts = append(counts, float64(n))
+			fields = append(fields, fmt.Sprintf("%s=%d", strings.TrimPrefix(endpoint, host+"/"), n))
+		}
+
+		if _, err := fmt.Fprintf(tw, "%s\t%d\t%d\t%.3f\t%s\n", host, total, len(endpoints), coefficientOfVariation(counts), strings.Join(fields, " ")); err != nil {
+			return err
+		}
+	}
+
+	return tw.Flush()
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCoefficientOfVariation(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		counts   []float64
+		expected float64
+	}{
+		{"even", []float64{100, 100, 100}, 0},
+		{"uneven", []float64{2, 4, 4, 4, 5, 5, 7, 9}, 0.4},
+		{"empty", nil, 0},
+	} {
+		if got := coefficientOfVariation(tc.counts); math.Abs(got-tc.expected) > 0.001 {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.expected, got)
+		}
+	}
+}
+
+func TestBalanceReport(t *testing.T) {
+	r := newBalanceReport(BoundBackendsByTrafficType{
+		HTTPTraffic: {
+			{Backend: Backend{Name: "a"}, Endpoints: make([]Endpoint, 2)},
+			{Backend: Backend{Name: "b"}, Endpoints: make([]Endpoint, 3)},
+		},
+	})
+	for i := 0; i < 3; i++ {
+		r.record("a", "a/0")
+		r.record("a", "a/1")
+	}
+	r.record("a", "")
+	// b's requests all go to one of its three endpoints.
+	for i := 0; i < 9; i++ {
+		r.record("b", "b/2")
+	}
+	// c's endpoints are unknown.
+	r.record("c", "c/0")
+
+	var out strings.Builder
+	if err := r.write(&out); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("expected a header and three rows, got %q", out.String())
+	}
+	for i, expected := range []string{
+		"a 6 2 0.000 0=3 1=3",
+		"b 9 3 1.414 0=0 1=0 2=9",
+		"c 1 1 0.000 0=1",
+	} {
+		if row := strings.Join(strings.Fields(lines[i+1]), " "); row != expected {
+			t.Errorf("expected %q, got %q", expected, row)
+		}
+	}
+}
+
+func TestMBClientSticky(t *testing.T) {
+	// The server pins a client to the endpoint named in its cookie
+	// when it has one and otherwise picks the next endpoint in turn,
+	// unless ignoreCookie is set.
+	for _, ignoreCookie := range []bool{false, true} {
+		next := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			endpoint := next % 3
+			next += 1
+			if cookie, err := r.Cookie("route"); err == nil && !ignoreCookie {
+				endpoint, _ = strconv.Atoi(cookie.Value)
+			}
+			http.SetCookie(w, &http.Cookie{Name: "route", Value: strconv.Itoa(endpoint), Secure: true})
+			w.Header().Set(BackendEndpointHeader, backendEndpointID("b", endpoint))
+		}))
+
+		u, err := url.Parse(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		port, _ := strconv.Atoi(u.Port())
+
+		c, err := newMBClient(context.Background(), MBRequest{Scheme: "http", Host: u.Hostname(), Port: port, Path: "/"}, nil, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var pinned, moved int
+		for i := 0; i < 5; i++ {
+			result := c.fetch(c.request, time.Now())
+			if result.err != nil {
+				t.Fatal(result.err)
+			}
+			if result.pinned {
+				pinned += 1
+			}
+			if result.moved {
+				moved += 1
+			}
+		}
+		server.Close()
+
+		expectedMoved := 0
+		if ignoreCookie {
+			// Served by 0, 1, 2, 0, 1.
+			expectedMoved = 3
+		}
+		if pinned != 1 || moved != expectedMoved {
+			t.Errorf("ignoreCookie=%v: expected 1 pinned and %v moved, got %v and %v", ignoreCookie, expectedMoved, pinned, moved)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"path"
+
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// envoyBootstrap is the subset of the Envoy bootstrap configuration
+// needed to run with static resources only.
+type envoyBootstrap struct {
+	Admin struct {
+		Address struct {
+			SocketAddress struct {
+				Address   string `json:"address"`
+				PortValue int    `json:"port_value"`
+			} `json:"socket_address"`
+		} `json:"address"`
+	} `json:"admin"`
+
+	StaticResources struct {
+		Listeners []json.RawMessage `json:"listeners"`
+		Clusters  []json.RawMessage `json:"clusters"`
+	} `json:"static_resources"`
+}
+
+func marshalEnvoyResources(resources []types.Resource) ([]json.RawMessage, error) {
+	var result []json.RawMessage
+
+	for _, r := range resources {
+		data, err := protojson.MarshalOptions{UseProtoNames: true}.Marshal(r)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, data)
+	}
+
+	return result, nil
+}
+
+func (c *GenEnvoyConfigCmd) Name() string {
+	return "envoy"
+}
+
+func (c *GenEnvoyConfigCmd) Run(p *ProgramCtx) error {
+	return runProxyConfigGenerator(p, c, false)
+}
+
+func (c *GenEnvoyConfigCmd) Generate(p *ProgramCtx, topology *ProxyTopology) error {
+	// The same listeners and clusters the control plane would
+	// serve, with endpoints and routes inline.
+	syncCmd := SyncEnvoyConfigCmd{EnvoyConfig: c.EnvoyConfig}
+	resources, err := syncCmd.resources(topology.BackendsByTrafficType, envoyCertificateFiles(topology.CertPaths), defaultEnvoyNodeOptions(p))
+	if err != nil {
+		return err
+	}
+
+	var bootstrap envoyBootstrap
+
+	bootstrap.Admin.Address.SocketAddress.Address = c.ListenAddress
+	bootstrap.Admin.Address.SocketAddress.PortValue = c.AdminPort
+
+	if bootstrap.StaticResources.Listeners, err = marshalEnvoyResources(resources[resource.ListenerType]); err != nil {
+		return err
+	}
+	if bootstrap.StaticResources.Clusters, err = marshalEnvoyResources(resources[resource.ClusterType]); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(bootstrap, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return createFile(path.Join(topology.Dir, "envoy.json"), data)
+}
@@ -70,6 +70,41 @@ func CreateTLSCerts(notBefore, notAfter time.Time, alternateNames ...string) (*C
 		return nil, err
 	}
 
+	return createLeafCert(&ca, caPrivKey, caPEM.String(), caPrivKeyPEM.String(), serialNumber, notBefore, notAfter, alternateNames...)
+}
+
+// ReissueTLSCerts generates a new leaf certificate for alternateNames
+// that is signed by the root CA in certs. Clients that already trust
+// the root CA continue to do so.
+func ReissueTLSCerts(certs *Certificates, notBefore, notAfter time.Time, alternateNames ...string) (*Certificates, error) {
+	caBlock, _ := pem.Decode([]byte(certs.RootCACertPEM))
+	if caBlock == nil {
+		return nil, fmt.Errorf("failed to decode root certificate")
+	}
+	ca, err := x509.ParseCertificate(caBlock.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse root certificate: %v", err)
+	}
+
+	caKeyBlock, _ := pem.Decode([]byte(certs.RootCAKeyPEM))
+	if caKeyBlock == nil {
+		return nil, fmt.Errorf("failed to decode root key")
+	}
+	caPrivKey, err := x509.ParsePKCS1PrivateKey(caKeyBlock.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse root key: %v", err)
+	}
+
+	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
+	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate serial number: %v", err)
+	}
+
+	return createLeafCert(ca, caPrivKey, certs.RootCACertPEM, certs.RootCAKeyPEM, serialNumber, notBefore, notAfter, alternateNames...)
+}
+
+func createLeafCert(ca *x509.Certificate, caPrivKey *rsa.PrivateKey, caPEM, caPrivKeyPEM string, serialNumber *big.Int, notBefore, notAfter time.Time, alternateNames ...string) (*Certificates, error) {
 	// server certificate
 	cert := x509.Certificate{
 		SerialNumber: serialNumber,
@@ -97,7 +132,7 @@ func CreateTLSCerts(notBefore, notAfter time.Time, alternateNames ...string) (*C
 		return nil, fmt.Errorf("failed to generate key: %v", err)
 	}
 
-	certBytes, err := x509.CreateCertificate(rand.Reader, &cert, &ca, &certPrivKey.PublicKey, caPrivKey)
+	certBytes, err := x509.CreateCertificate(rand.Reader, &cert, ca, &certPrivKey.PublicKey, caPrivKey)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create leaf certificate: %v", err)
 	}
@@ -121,7 +156,7 @@ func CreateTLSCerts(notBefore, notAfter time.Time, alternateNames ...string) (*C
 	return &Certificates{
 		LeafCertPEM:   certPEM.String(),
 		LeafKeyPEM:    certPrivKeyPEM.String(),
-		RootCACertPEM: caPEM.String(),
-		RootCAKeyPEM:  caPrivKeyPEM.String(),
+		RootCACertPEM: caPEM,
+		RootCAKeyPEM:  caPrivKeyPEM,
 	}, nil
 }
@@ -72,3 +72,38 @@ func TestCertGen(t *testing.T) {
 		t.Fatalf(`expected "success", got %q`, body)
 	}
 }
+
+func TestReissueCerts(t *testing.T) {
+	certBundle, err := CreateTLSCerts(time.Now(), time.Now().AddDate(1, 0, 0), "a.example.com")
+	if err != nil {
+		t.Fatalf("failed to generate certificates: %v", err)
+	}
+
+	reissued, err := ReissueTLSCerts(certBundle, time.Now(), time.Now().AddDate(1, 0, 0), "a.example.com", "b.example.com")
+	if err != nil {
+		t.Fatalf("failed to reissue certificates: %v", err)
+	}
+
+	if reissued.RootCACertPEM != certBundle.RootCACertPEM {
+		t.Fatalf("expected the root CA to be unchanged")
+	}
+
+	leaf, err := tls.X509KeyPair([]byte(reissued.LeafCertPEM), []byte(reissued.LeafKeyPEM))
+	if err != nil {
+		t.Fatalf("failed to create key pair: %v", err)
+	}
+
+	cert, err := x509.ParseCertificate(leaf.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certpool := x509.NewCertPool()
+	certpool.AppendCertsFromPEM([]byte(certBundle.RootCACertPEM))
+
+	for _, name := range []string{"a.example.com", "b.example.com"} {
+		if _, err := cert.Verify(x509.VerifyOptions{DNSName: name, Roots: certpool}); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
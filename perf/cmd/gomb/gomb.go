@@ -15,10 +15,13 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/alecthomas/kong"
+
+	"github.com/frobware/haproxy-openshift/perf/histogram"
 )
 
 // MBRequest is a Multiple-host HTTP(s) Benchmarking tool request.
@@ -35,6 +38,7 @@ type MBRequest struct {
 
 type Globals struct {
 	Duration    time.Duration `help:"Test duration" short:"d" default:"60s"`
+	HostPrefix  string        `help:"Hostname prefix" default:"perf-test-hydra"`
 	RequestFile string        `help:"Request file." short:"i" type:"existingfile"`
 	TLSReuse    bool          `help:"Enable TLS session reuse" default:"true"`
 }
@@ -49,9 +53,21 @@ type CLI struct {
 }
 
 type fetchResult struct {
-	req  *http.Request
-	resp *http.Response
-	err  error
+	req     *http.Request
+	status  int
+	latency time.Duration
+	err     error
+}
+
+// trafficType recovers the traffic type from a hostname generated
+// by serve-backends (<prefix>-<type>-<n>).
+func trafficType(hostPrefix, host string) (string, bool) {
+	rest := strings.TrimPrefix(host, hostPrefix+"-")
+	i := strings.LastIndex(rest, "-")
+	if rest == host || i <= 0 {
+		return "", false
+	}
+	return rest[:i], true
 }
 
 func newHTTPClient() *http.Client {
@@ -93,7 +109,16 @@ func Run(ctx *kong.Context, p *ProgramCtx) error {
 
 	fetch := func(req *http.Request, client *http.Client) *fetchResult {
 		result := &fetchResult{req: req}
-		result.resp, result.err = client.Do(req)
+		start := time.Now()
+		resp, err := client.Do(req)
+		if err != nil {
+			result.err = err
+			return result
+		}
+		_, result.err = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		result.latency = time.Since(start)
+		result.status = resp.StatusCode
 		return result
 	}
 
@@ -122,6 +147,9 @@ func Run(ctx *kong.Context, p *ProgramCtx) error {
 		}
 	}
 
+	latencies := histogram.NewReport(nil, func(host string) (string, bool) {
+		return trafficType(p.Globals.HostPrefix, host)
+	})
 	fetchErrors := 0
 	fetchBadStatus := 0
 	hits := 0
@@ -143,7 +171,7 @@ func Run(ctx *kong.Context, p *ProgramCtx) error {
 
 		case <-testComplete:
 			log.Printf("hits: %v errors: %v bad_status: %v request/s: %.0f", hits, fetchErrors, fetchBadStatus, float64(hits)/float64(p.Globals.Duration.Seconds()))
-			return nil
+			return latencies.Write(os.Stdout)
 
 		case <-progressTicker:
 			log.Printf("hits: %v errors: %v", hits, fetchErrors)
@@ -159,12 +187,11 @@ func Run(ctx *kong.Context, p *ProgramCtx) error {
 				log.Printf("%s %q failed: %v", result.req.Method, result.req.URL, result.err)
 				continue
 			}
-			if result.resp.StatusCode != http.StatusOK {
+			latencies.Record(result.req.URL.Hostname(), result.latency)
+			if result.status != http.StatusOK {
 				fetchBadStatus += 1
-				log.Printf("%s %q bad_status: %v", result.req.Method, result.req.URL, result.resp.StatusCode)
+				log.Printf("%s %q bad_status: %v", result.req.Method, result.req.URL, result.status)
 			}
-			io.Copy(io.Discard, result.resp.Body)
-			result.resp.Body.Close()
 		}
 	}
 }
@@ -24,12 +24,22 @@ type Globals struct {
 type CLI struct {
 	Globals
 
+	Compare         CompareCmd         `cmd:"" help:"Compare benchmark results for significant differences."`
+	Failover        FailoverCmd        `cmd:"" help:"Measure how long the proxy takes to stop, and resume, routing to a failed backend endpoint."`
+	GenEnvoyConfig  GenEnvoyConfigCmd  `cmd:"" help:"Generate a static Envoy bootstrap configuration."`
 	GenHosts        GenHostsCmd        `cmd:"" help:"Generate host names (/etc/hosts compatible)."`
+	GenNginxConfig  GenNginxConfigCmd  `cmd:"" help:"Generate nginx configuration."`
 	GenProxyConfig  GenProxyConfigCmd  `cmd:"" help:"Generate HAProxy configuration."`
 	SyncEnvoyConfig SyncEnvoyConfigCmd `cmd:"" help:"Sync Envoy configuration by starting a Envoy Control Plane."`
 	GenWorkload     GenWorkloadCmd     `cmd:"" help:"Generate https://github.com/jmencak/mb requests."`
+	ReloadTest      ReloadTestCmd      `cmd:"" help:"Run a workload while reloading HAProxy and measure the disruption of each reload."`
+	Run             RunCmd             `cmd:"" help:"Run a complete benchmark and record the results."`
 	ServeBackend    ServeBackendCmd    `cmd:"" help:"Serve backend." hidden:"true"`
 	ServeBackends   ServeBackendsCmd   `cmd:"" help:"Serve backends."`
+	ServeEnvoy      ServeEnvoyCmd      `cmd:"" help:"Run Envoy with a generated configuration, hot restarting it on changes."`
+	ServeHAProxy    ServeHAProxyCmd    `cmd:"" name:"serve-haproxy" help:"Run HAProxy with a generated configuration, reloading it on changes."`
+	ServeProxy      ServeProxyCmd      `cmd:"" help:"Serve a reference reverse proxy routing to the backends."`
+	Summarize       SummarizeCmd       `cmd:"" help:"Summarise benchmark results."`
 	Test            TestCmd            `cmd:"" help:"Run client test using requests file."`
 	Version         VersionCmd         `cmd:"" help:"Print version information and quit."`
 }
@@ -40,43 +50,150 @@ type ProgramCtx struct {
 }
 
 type TestCmd struct {
+	Arrival     string        `help:"Arrival process for --rate (constant, poisson)." enum:"constant,poisson" default:"constant"`
 	Duration    time.Duration `help:"Test duration" short:"d" default:"60s"`
+	Rate        float64       `help:"Send requests at this many per second, open loop, instead of back-to-back. The rate is split between the requests in proportion to their clients." default:"0"`
 	RequestFile string        `help:"Request file." short:"i" type:"existingfile"`
+	Sticky      bool          `help:"Replay the cookies set by the proxy and fail if a client's requests are served by more than one endpoint."`
+}
+
+type FailoverCmd struct {
+	Backend         string        `help:"Backend to fail (default: the first of --traffic-type)."`
+	Down            time.Duration `help:"How long the endpoint is kept down." default:"10s"`
+	Fault           string        `help:"How the endpoint fails (refuse, health-check, hang). health-check needs the proxy's --health-check-path." enum:"refuse,health-check,hang" default:"refuse"`
+	ProbeInterval   time.Duration `help:"Interval between probes of the route through the proxy." default:"10ms"`
+	ProbeTimeout    time.Duration `help:"Time after which a probe fails." default:"2s"`
+	RecoveryTimeout time.Duration `help:"How long to wait for the proxy to route to the endpoint once it is restored." default:"30s"`
+	Replica         int           `help:"Replica of the backend to fail." default:"0"`
+	TrafficType     TrafficType   `help:"Traffic type of the backend." default:"http"`
+	Warmup          time.Duration `help:"How long to probe before failing the endpoint." default:"2s"`
 }
 
 type GenProxyConfigCmd struct {
 	EnableHTTP2                 bool   `default:"true"`
 	EnableLogging               bool   `default:"true"`
 	HealthCheckIntervalInMillis int    `default:"1000"`
+	HealthCheckPath             string `help:"Check HTTP backends with a GET of this path (e.g., /healthz) instead of a TCP connect." default:""`
 	ListenAddress               string `default:""`
 	Maxconn                     int    `default:"0"`
 	Nthreads                    int    `default:"4"`
 	StatsPort                   int    `default:"1936"`
 	UseUnixDomainSockets        bool   `default:"true"`
+	Watch                       bool   `help:"Regenerate the configuration whenever the backend topology changes." default:"false"`
+}
+
+// EnvoyConfig holds the options shared by gen-envoy-config and
+// sync-envoy-config.
+type EnvoyConfig struct {
+	EnableHTTP2                 bool   `help:"Negotiate HTTP/2 with clients and reencrypt backends, as gen-proxy-config --enable-http-2 does for HAProxy." default:"true"`
+	EnableLogging               bool   `default:"true"`
+	HealthCheckIntervalInMillis int    `default:"1000"`
+	HealthCheckPath             string `help:"Check HTTP backends with a GET of this path (e.g., /healthz) instead of a TCP connect." default:""`
+	ListenAddress               string `default:"127.0.0.1"`
 }
 
 type SyncEnvoyConfigCmd struct {
-	EnableLogging bool   `default:"true"`
-	XdsServerPort int    `default:"18000"`
-	ListenAddress string `default:"127.0.0.1"`
+	EnvoyConfig `embed:""`
+
+	DynamicResources bool `help:"Publish endpoints over EDS and routes over RDS instead of inline in clusters and listeners." default:"false"`
+	XdsServerPort    int  `default:"18000"`
+	Watch            bool `help:"Push a new snapshot whenever the backend topology changes." default:"false"`
+}
+
+type CompareCmd struct {
+	Dirs      []string `arg:"" help:"RESULTS/<date> directories; the first is the baseline." type:"existingdir"`
+	Alpha     float64  `help:"Significance level." default:"0.05"`
+	Format    string   `help:"Output format (table, json)." enum:"table,json" default:"table"`
+	Threshold float64  `help:"Fail if requests/s drops, or p99 latency rises, significantly by more than this percentage." default:"5"`
+}
+
+type GenEnvoyConfigCmd struct {
+	EnvoyConfig `embed:""`
+
+	AdminPort int `help:"Envoy admin port." default:"9901"`
 }
 
 type GenHostsCmd struct {
 	IPAddress string
 }
 
+type GenNginxConfigCmd struct {
+	EnableHTTP2                 bool   `help:"Enable HTTP/2 with \"http2 on\", which needs nginx 1.25.1 or later." default:"true"`
+	EnableLogging               bool   `default:"true"`
+	HealthCheckIntervalInMillis int    `default:"1000"`
+	ListenAddress               string `default:""`
+	UseUnixDomainSockets        bool   `default:"true"`
+	WorkerConnections           int    `default:"10240"`
+	WorkerProcesses             int    `default:"4"`
+}
+
 type GenWorkloadCmd struct {
-	UseProxy bool `default:"true"`
+	Clients           []int    `help:"Client counts to generate request files for." default:"1,2,5,10,50,75,80,90,100,200"`
+	KeepAliveRequests []int    `help:"Keep-alive request counts to generate request files for." default:"0"`
+	Responses         []string `help:"Responses to mix in each request file, splitting each backend's clients between them: static, small, large, delayed, jittered, chunked, streamed, gzip, not-found, unavailable, or a query string such as size=4096&delay=5ms." default:"static"`
+	UseProxy          bool     `default:"true"`
 }
 
 type ServeBackendsCmd struct {
+	InProcess     bool   `help:"Serve all backends as goroutines in this process instead of one child process per backend." default:"false"`
 	ListenAddress string `default:"127.0.0.1"`
+	Replicas      int    `help:"Number of endpoints serving each backend." default:"1"`
+}
+
+type ServeProxyCmd struct {
+	ListenAddress string `default:""`
+	Watch         bool   `help:"Update routes whenever the backend topology changes." default:"true"`
+}
+
+type ServeHAProxyCmd struct {
+	HAProxy       string        `name:"haproxy" help:"HAProxy binary." default:"haproxy"`
+	LogFile       string        `help:"File HAProxy's output is written to (default: <output-dir>/haproxy.log)."`
+	ReloadTimeout time.Duration `help:"How long HAProxy may take to start, or to start a new worker on reload." default:"30s"`
+	Watch         bool          `help:"Regenerate the configuration and reload whenever the backend topology changes." default:"true"`
+
+	Proxy GenProxyConfigCmd `embed:"" prefix:"proxy-"`
+}
+
+type ServeEnvoyCmd struct {
+	BaseID        int           `name:"base-id" help:"Envoy --base-id, to run alongside other Envoys." default:"0"`
+	DrainTime     time.Duration `help:"How long an old Envoy drains connections after a hot restart." default:"5s"`
+	Envoy         string        `help:"Envoy binary." default:"envoy"`
+	LogFile       string        `help:"File Envoy's output is written to (default: <output-dir>/envoy.log)."`
+	ReloadTimeout time.Duration `help:"How long Envoy may take to start, or to take over on a hot restart." default:"30s"`
+	Watch         bool          `help:"Regenerate the configuration and hot restart whenever the backend topology changes." default:"true"`
+
+	Proxy GenEnvoyConfigCmd `embed:"" prefix:"envoy-"`
 }
 
 type ServeBackendCmd struct {
 	Name          string      `default:""`
 	ListenAddress string      `default:""`
+	Replicas      int         `default:"1"`
 	TrafficType   TrafficType `default:""`
 }
 
+type ReloadTestCmd struct {
+	Duration         time.Duration `help:"Test duration" short:"d" default:"60s"`
+	HAProxy          string        `name:"haproxy" help:"HAProxy binary." default:"haproxy"`
+	Interval         time.Duration `help:"Reload every interval." default:"5s"`
+	OnTopologyChange bool          `help:"Regenerate the configuration and reload whenever the backend topology changes, instead of on an interval."`
+	ReloadTimeout    time.Duration `help:"How long a new HAProxy process may take to take over." default:"30s"`
+	RequestFile      string        `help:"Request file." short:"i" type:"existingfile" required:""`
+
+	Proxy GenProxyConfigCmd `embed:"" prefix:"proxy-"`
+}
+
+type RunCmd struct {
+	Spec string `help:"Benchmark specification (JSON)." short:"s" type:"existingfile"`
+
+	Backends ServeBackendsCmd  `embed:"" prefix:"backends-"`
+	Envoy    GenEnvoyConfigCmd `embed:"" prefix:"envoy-"`
+	Proxy    GenProxyConfigCmd `embed:"" prefix:"proxy-"`
+}
+
+type SummarizeCmd struct {
+	Dirs   []string `arg:"" help:"RESULTS/<date> directories." type:"existingdir"`
+	Format string   `help:"Output format (table, json, csv)." enum:"table,json,csv" default:"table"`
+}
+
 type VersionCmd struct{}
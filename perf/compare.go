@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"text/tabwriter"
+)
+
+const (
+	verdictRegression  = "regression"
+	verdictImprovement = "improvement"
+	verdictNoChange    = "no significant change"
+)
+
+// ResultComparison compares a candidate resultSet against a baseline
+// for one traffic type.
+type ResultComparison struct {
+	TrafficType     string   `json:"traffic_type"`
+	Baseline        string   `json:"baseline"`
+	Candidate       string   `json:"candidate"`
+	BaselineRPS     float64  `json:"baseline_rps"`
+	CandidateRPS    float64  `json:"candidate_rps"`
+	RPSDeltaPercent float64  `json:"rps_delta_percent"`
+	RPSPValue       float64  `json:"rps_p_value"`
+	BaselineP99     *float64 `json:"baseline_p99_ms,omitempty"`
+	CandidateP99    *float64 `json:"candidate_p99_ms,omitempty"`
+	P99DeltaPercent *float64 `json:"p99_delta_percent,omitempty"`
+	P99PValue       *float64 `json:"p99_p_value,omitempty"`
+	Verdict         string   `json:"verdict"`
+}
+
+func percentChange(from, to float64) float64 {
+	if from == 0 {
+		return 0
+	}
+	return 100 * (to - from) / from
+}
+
+// matchResultSet finds the set in candidates that corresponds to
+// baseline: the same host and traffic type if there is one,
+// otherwise the only set with the same traffic type. It is an error
+// if there is no such set, or more than one.
+func matchResultSet(baseline *resultSet, candidates []*resultSet) (*resultSet, error) {
+	var sameType []*resultSet
+	for _, c := range candidates {
+		if c.TrafficType != baseline.TrafficType {
+			continue
+		}
+		if c.Host == baseline.Host {
+			return c, nil
+		}
+		sameType = append(sameType, c)
+	}
+	switch len(sameType) {
+	case 0:
+		return nil, fmt.Errorf("no %s results", baseline.TrafficType)
+	case 1:
+		return sameType[0], nil
+	default:
+		return nil, fmt.Errorf("%d hosts with %s results and none is %s", len(sameType), baseline.TrafficType, baseline.Host)
+	}
+}
+
+func (c *CompareCmd) compare(baseline, candidate *resultSet) ResultComparison {
+	baselineRPS, candidateRPS := baseline.requestsPerSec(), candidate.requestsPerSec()
+	_, rpsPValue := mannWhitneyU(baselineRPS, candidateRPS)
+
+	result := ResultComparison{
+		TrafficType:  baseline.TrafficType,
+		Baseline:     baseline.Results + "/" + baseline.Host,
+		Candidate:    candidate.Results + "/" + candidate.Host,
+		BaselineRPS:  mean(baselineRPS),
+		CandidateRPS: mean(candidateRPS),
+		RPSPValue:    rpsPValue,
+	}
+	result.RPSDeltaPercent = percentChange(result.BaselineRPS, result.CandidateRPS)
+
+	regression := result.RPSDeltaPercent < -c.Threshold && rpsPValue < c.Alpha
+	improvement := result.RPSDeltaPercent > c.Threshold && rpsPValue < c.Alpha
+
+	if baselineP99, candidateP99 := baseline.latencies(true), candidate.latencies(true); len(baselineP99) > 0 && len(candidateP99) > 0 {
+		_, p99PValue := mannWhitneyU(baselineP99, candidateP99)
+		baselineMean, candidateMean := mean(baselineP99), mean(candidateP99)
+		delta := percentChange(baselineMean, candidateMean)
+		result.BaselineP99 = &baselineMean
+		result.CandidateP99 = &candidateMean
+		result.P99DeltaPercent = &delta
+		result.P99PValue = &p99PValue
+		regression = regression || (delta > c.Threshold && p99PValue < c.Alpha)
+		improvement = improvement || (delta < -c.Threshold && p99PValue < c.Alpha)
+	}
+
+	switch {
+	case regression:
+		result.Verdict = verdictRegression
+	case improvement:
+		result.Verdict = verdictImprovement
+	default:
+		result.Verdict = verdictNoChange
+	}
+
+	return result
+}
+
+func formatOptional(format string, v *float64) string {
+	if v == nil {
+		return "-"
+	}
+	return fmt.Sprintf(format, *v)
+}
+
+func writeComparisonTable(w io.Writer, comparisons []ResultComparison) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	if _, err := fmt.Fprintln(tw, "traffic\tbaseline\tcandidate\trequests/s\t\tdelta\tp-value\tp99 ms\t\tdelta\tp-value\tverdict"); err != nil {
+		return err
+	}
+	for _, r := range comparisons {
+		if _, err := fmt.Fprintf(tw, "%s\t%s\t%s\t%.0f\t%.0f\t%+.2f%%\t%.4f\t%s\t%s\t%s\t%s\t%s\n",
+			r.TrafficType, r.Baseline, r.Candidate,
+			r.BaselineRPS, r.CandidateRPS, r.RPSDeltaPercent, r.RPSPValue,
+			formatOptional("%.3f", r.BaselineP99), formatOptional("%.3f", r.CandidateP99),
+			formatOptional("%+.2f%%", r.P99DeltaPercent), formatOptional("%.4f", r.P99PValue),
+			r.Verdict); err != nil {
+			return err
+		}
+	}
+	return tw.Flush()
+}
+
+func (c *CompareCmd) Run(p *ProgramCtx) error {
+	if len(c.Dirs) < 2 {
+		return fmt.Errorf("at least two results directories are required")
+	}
+
+	baseline, err := loadResults(c.Dirs[0])
+	if err != nil {
+		return err
+	}
+
+	var comparisons []ResultComparison
+	unmatched := 0
+
+	for _, dir := range c.Dirs[1:] {
+		candidates, err := loadResults(dir)
+		if err != nil {
+			return err
+		}
+		for _, b := range baseline {
+			candidate, err := matchResultSet(b, candidates)
+			if err != nil {
+				log.Printf("%s/%s/%s: %s: %v", b.Results, b.Host, b.TrafficType, dir, err)
+				unmatched += 1
+				continue
+			}
+			comparisons = append(comparisons, c.compare(b, candidate))
+		}
+	}
+
+	switch c.Format {
+	case "json":
+		data, err := json.MarshalIndent(comparisons, "", "  ")
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Println(string(data)); err != nil {
+			return err
+		}
+	default:
+		if err := writeComparisonTable(os.Stdout, comparisons); err != nil {
+			return err
+		}
+	}
+
+	regressions := 0
+	for _, r := range comparisons {
+		if r.Verdict == verdictRegression {
+			regressions += 1
+		}
+	}
+	if regressions > 0 {
+		return fmt.Errorf("%d regression(s) beyond %.1f%% at alpha=%v", regressions, c.Threshold, c.Alpha)
+	}
+	if unmatched > 0 {
+		return fmt.Errorf("%d baseline result set(s) could not be compared", unmatched)
+	}
+
+	return nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+func TestMatchResultSet(t *testing.T) {
+	set := func(host, trafficType string) *resultSet {
+		return &resultSet{Host: host, TrafficType: trafficType}
+	}
+	baseline := set("a", "edge")
+
+	for _, tc := range []struct {
+		name       string
+		candidates []*resultSet
+		expected   int
+	}{
+		{"same host", []*resultSet{set("b", "edge"), set("a", "edge")}, 1},
+		{"only set of the traffic type", []*resultSet{set("b", "http"), set("b", "edge")}, 1},
+		{"missing", []*resultSet{set("a", "http")}, -1},
+		{"ambiguous", []*resultSet{set("b", "edge"), set("c", "edge")}, -1},
+	} {
+		match, err := matchResultSet(baseline, tc.candidates)
+		if tc.expected < 0 {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %+v", tc.name, match)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+		} else if match != tc.candidates[tc.expected] {
+			t.Errorf("%s: expected %+v, got %+v", tc.name, tc.candidates[tc.expected], match)
+		}
+	}
+}
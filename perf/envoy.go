@@ -15,21 +15,22 @@ import (
 	hcm "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
 	tcpproxy "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/tcp_proxy/v3"
 	tlsv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	upstreamhttp "github.com/envoyproxy/go-control-plane/envoy/extensions/upstreams/http/v3"
 	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
 	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
 	"github.com/envoyproxy/go-control-plane/pkg/wellknown"
 	"github.com/golang/protobuf/ptypes"
-	"github.com/yookoala/realpath"
 	"google.golang.org/grpc"
 	"google.golang.org/protobuf/encoding/prototext"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 	"log"
-	"math/rand"
 	"net"
 	"os"
 	"os/signal"
-	"path"
+	"strconv"
 	"sync"
 	"time"
 
@@ -45,15 +46,112 @@ type Callbacks struct {
 	Debug     bool
 	Fetches   int
 	Requests  int
-	Responses []*discoverygrpc.DiscoveryResponse
+	Responded map[string]bool
 	mu        sync.Mutex
+
+	// OnNode is called when a node opens a stream.
+	OnNode func(node *core.Node)
+
+	// OnNodeClosed is called when a node's last stream closes.
+	OnNodeClosed func(nodeID string)
+
+	// Envoy only sends its node on the first request of a stream.
+	streamNodes map[int64]string
+
+	// The most recent snapshot version, when it was set and the
+	// node and resource types that have acknowledged it.
+	snapshotVersion string
+	snapshotTime    time.Time
+	acked           map[string]bool
+}
+
+// envoyNodeOptions are per-node settings taken from the node
+// metadata in the Envoy bootstrap, for example:
+//
+//	node:
+//	  id: envoy-1
+//	  metadata:
+//	    http_port: 8081
+//	    https_port: 8444
+//	    https_sni_only_port: 9444
+//	    shard: 1
+//	    shards: 2
+//
+// A node with shards > 1 is only configured with every shards'th
+// backend of each traffic type, starting from shard.
+type envoyNodeOptions struct {
+	HTTPPort         uint32
+	HTTPSPort        uint32
+	HTTPSPortSNIOnly uint32
+	Shard            int
+	Shards           int
+}
+
+func defaultEnvoyNodeOptions(p *ProgramCtx) envoyNodeOptions {
+	return envoyNodeOptions{
+		HTTPPort:         uint32(p.HTTPPort),
+		HTTPSPort:        uint32(p.HTTPSPort),
+		HTTPSPortSNIOnly: uint32(p.HTTPSPortSNIOnly),
+		Shard:            0,
+		Shards:           1,
+	}
+}
+
+func parseEnvoyNodeOptions(node *core.Node, defaults envoyNodeOptions) (envoyNodeOptions, error) {
+	options := defaults
+
+	for key, dest := range map[string]func(int){
+		"http_port":           func(v int) { options.HTTPPort = uint32(v) },
+		"https_port":          func(v int) { options.HTTPSPort = uint32(v) },
+		"https_sni_only_port": func(v int) { options.HTTPSPortSNIOnly = uint32(v) },
+		"shard":               func(v int) { options.Shard = v },
+		"shards":              func(v int) { options.Shards = v },
+	} {
+		value, ok := node.GetMetadata().GetFields()[key]
+		if !ok {
+			continue
+		}
+		switch kind := value.GetKind().(type) {
+		case *structpb.Value_NumberValue:
+			dest(int(kind.NumberValue))
+		case *structpb.Value_StringValue:
+			v, err := strconv.Atoi(kind.StringValue)
+			if err != nil {
+				return options, fmt.Errorf("node %s: metadata %s: %v", node.GetId(), key, err)
+			}
+			dest(v)
+		default:
+			return options, fmt.Errorf("node %s: metadata %s: expected a number", node.GetId(), key)
+		}
+	}
+
+	if options.Shards < 1 || options.Shard < 0 || options.Shard >= options.Shards {
+		return options, fmt.Errorf("node %s: invalid shard %d of %d", node.GetId(), options.Shard, options.Shards)
+	}
+
+	return options, nil
+}
+
+// shard returns the backends assigned to this node.
+func (o envoyNodeOptions) shard(backendsByTrafficType BoundBackendsByTrafficType) BoundBackendsByTrafficType {
+	if o.Shards == 1 {
+		return backendsByTrafficType
+	}
+
+	result := BoundBackendsByTrafficType{}
+	for t, backends := range backendsByTrafficType {
+		for i, b := range backends {
+			if i%o.Shards == o.Shard {
+				result[t] = append(result[t], b)
+			}
+		}
+	}
+	return result
 }
 
 const (
 	exitCodeErr       = 1
 	exitCodeInterrupt = 2
-	proxyHttpPort     = 8080
-	proxyHttpsPort    = 8443
 )
 
 func (c *SyncEnvoyConfigCmd) Run(p *ProgramCtx) error {
@@ -64,13 +162,7 @@ func (c *SyncEnvoyConfigCmd) Run(p *ProgramCtx) error {
 		return err
 	}
 
-	certBundle, err := fetchCertficates(p.DiscoveryURL)
-	if err != nil {
-		return err
-	}
-
-	realPath, _ := realpath.Realpath(p.OutputDir)
-	certPaths, err := writeCertificates(path.Join(realPath, "certs"), certBundle)
+	certs, err := fetchCertficates(p.DiscoveryURL)
 	if err != nil {
 		return err
 	}
@@ -92,24 +184,180 @@ func (c *SyncEnvoyConfigCmd) Run(p *ProgramCtx) error {
 		os.Exit(exitCodeInterrupt)
 	}()
 
+	var (
+		// Seeded from the clock so that a restarted control
+		// plane does not reuse a version a connected Envoy
+		// already has.
+		version  = uint64(time.Now().Unix())
+		created  bool
+		typeURLs []string
+		nodes    = map[string]*core.Node{}
+		mu       sync.Mutex
+	)
+
 	signal := make(chan struct{})
 	cb := &Callbacks{
-		Signal:   signal,
-		Fetches:  0,
-		Requests: 0,
+		Signal:      signal,
+		Fetches:     0,
+		Requests:    0,
+		Responded:   map[string]bool{},
+		streamNodes: map[int64]string{},
+		acked:       map[string]bool{},
 	}
 
 	cache := cachev3.NewSnapshotCache(true, cachev3.IDHash{}, nil)
 	srv := serverv3.NewServer(ctx, cache, cb)
 
+	// setNodeSnapshot must be called with mu held.
+	setNodeSnapshot := func(node *core.Node) error {
+		options, err := parseEnvoyNodeOptions(node, defaultEnvoyNodeOptions(p))
+		if err != nil {
+			return err
+		}
+
+		resources, err := c.resources(options.shard(backendsByTrafficType), envoyCertificatesInline(certs), options)
+		if err != nil {
+			return err
+		}
+		typeURLs = typeURLs[:0]
+		for typeURL := range resources {
+			typeURLs = append(typeURLs, typeURL)
+		}
+
+		snap, err := cachev3.NewSnapshot(fmt.Sprint(version), resources)
+		if err != nil {
+			return fmt.Errorf("could not create snapshot: %v", err)
+		}
+		if err := snap.Consistent(); err != nil {
+			return fmt.Errorf("snapshot inconsistency: %+v\n%+v", snap, err)
+		}
+		if err := cache.SetSnapshot(ctx, node.GetId(), snap); err != nil {
+			return fmt.Errorf("could not set snapshot: %v", err)
+		}
+		return nil
+	}
+
+	setSnapshot := func() error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		version += 1
+		created = true
+		log.Printf("Creating snapshot Version %v for %d node(s)", version, len(nodes))
+		cb.snapshotSet(fmt.Sprint(version))
+
+		for _, node := range nodes {
+			if err := setNodeSnapshot(node); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	cb.OnNode = func(node *core.Node) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		log.Printf("Envoy %s Connected", node.GetId())
+		nodes[node.GetId()] = node
+
+		if !created {
+			// The node is included when the first snapshot
+			// is created.
+			return
+		}
+		if err := setNodeSnapshot(node); err != nil {
+			log.Printf("Envoy %s: %v", node.GetId(), err)
+		}
+	}
+
+	cb.OnNodeClosed = func(nodeID string) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		log.Printf("Envoy %s Disconnected", nodeID)
+		delete(nodes, nodeID)
+		cache.ClearSnapshot(nodeID)
+	}
+
 	// start the xDS server
 	go RunManagementServer(ctx, srv, c.XdsServerPort)
 	<-signal
 	log.Printf("Envoy Connected")
 
-	nodeId := cache.GetStatusKeys()[0]
+	if !c.Watch {
+		if err := setSnapshot(); err != nil {
+			return err
+		}
+		for !cb.allResponsesSent(typeURLs) {
+			log.Printf("Waiting for Envoy to sync...")
+			time.Sleep(1 * time.Second)
+		}
+		// Envoys that connect later are given the snapshot as
+		// they do, so keep serving it until interrupted.
+		<-ctx.Done()
+		return nil
+	}
+
+	return watchBackendMetadata(ctx, p.DiscoveryURL, func(topologyVersion uint64, topology BoundBackendsByTrafficType) error {
+		log.Printf("Topology version %v", topologyVersion)
+		// The leaf certificate is reissued as backends are
+		// added, so fetch it every time.
+		bundle, err := fetchCertficates(p.DiscoveryURL)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		backendsByTrafficType = topology
+		certs = bundle
+		mu.Unlock()
+		return setSnapshot()
+	})
+}
+
+// resources builds the clusters and listeners for
+// backendsByTrafficType.
+// envoyCertificates are where Envoy reads the proxy's certificate,
+// key and root CA from.
+type envoyCertificates struct {
+	TLSCert *core.DataSource
+	TLSKey  *core.DataSource
+	RootCA  *core.DataSource
+}
+
+// envoyCertificateFiles reads the certificates from the files
+// written to certPaths, for a static configuration.
+func envoyCertificateFiles(certPaths *CertStore) envoyCertificates {
+	file := func(filename string) *core.DataSource {
+		return &core.DataSource{
+			Specifier: &core.DataSource_Filename{Filename: filename},
+		}
+	}
+	return envoyCertificates{
+		TLSCert: file(certPaths.TLSCertFile),
+		TLSKey:  file(certPaths.TLSKeyFile),
+		RootCA:  file(certPaths.RootCAFile),
+	}
+}
+
+// envoyCertificatesInline carries the certificates in certs in the
+// configuration itself. Envoy does not reread certificate files, so
+// a snapshot for a reissued certificate must change its bytes.
+func envoyCertificatesInline(certs *Certificates) envoyCertificates {
+	inline := func(pem string) *core.DataSource {
+		return &core.DataSource{
+			Specifier: &core.DataSource_InlineString{InlineString: pem},
+		}
+	}
+	return envoyCertificates{
+		TLSCert: inline(certs.LeafCertPEM),
+		TLSKey:  inline(certs.LeafKeyPEM),
+		RootCA:  inline(certs.RootCACertPEM),
+	}
+}
 
-	var listeners, clusters []types.Resource
+func (c *SyncEnvoyConfigCmd) resources(backendsByTrafficType BoundBackendsByTrafficType, certs envoyCertificates, options envoyNodeOptions) (map[string][]types.Resource, error) {
+	var listeners, clusters, endpoints []types.Resource
 
 	var httpVirtualHosts, httpsVirtualHosts []*route.VirtualHost
 	var passthroughFilterChains []*listenerv3.FilterChain
@@ -119,25 +367,13 @@ func (c *SyncEnvoyConfigCmd) Run(p *ProgramCtx) error {
 	commonHttpsTlsContext := &tlsv3.CommonTlsContext{
 		TlsCertificates: []*tlsv3.TlsCertificate{
 			{
-				CertificateChain: &core.DataSource{
-					Specifier: &core.DataSource_Filename{
-						Filename: certPaths.TLSCertFile,
-					},
-				},
-				PrivateKey: &core.DataSource{
-					Specifier: &core.DataSource_Filename{
-						Filename: certPaths.TLSKeyFile,
-					},
-				},
+				CertificateChain: certs.TLSCert,
+				PrivateKey:       certs.TLSKey,
 			},
 		},
 		ValidationContextType: &tlsv3.CommonTlsContext_ValidationContext{
 			ValidationContext: &tlsv3.CertificateValidationContext{
-				TrustedCa: &core.DataSource{
-					Specifier: &core.DataSource_Filename{
-						Filename: certPaths.RootCAFile,
-					},
-				},
+				TrustedCa: certs.RootCA,
 			},
 		},
 	}
@@ -168,131 +404,167 @@ func (c *SyncEnvoyConfigCmd) Run(p *ProgramCtx) error {
 		}
 	}
 
-	for t, backends := range backendsByTrafficType {
-		for _, b := range backends {
-			if t == HTTPTraffic {
-				httpVirtualHost := &route.VirtualHost{
-					Name:    b.Name,
-					Domains: []string{fmt.Sprintf("%s:%d", b.Name, proxyHttpPort), b.Name},
-					Routes: []*route.Route{
-						{
-							Match: &route.RouteMatch{
-								PathSpecifier: &route.RouteMatch_Prefix{
-									Prefix: "/",
-								},
-							},
-							Action: &route.Route_Route{
-								Route: &route.RouteAction{
-									ClusterSpecifier: &route.RouteAction_Cluster{
-										Cluster: b.Name,
-									},
-								},
-							},
+	virtualHost := func(b BoundBackend, ports ...uint32) *route.VirtualHost {
+		var domains []string
+		for _, port := range ports {
+			domains = append(domains, fmt.Sprintf("%s:%d", b.Name, port))
+		}
+		return &route.VirtualHost{
+			Name:    b.Name,
+			Domains: append(domains, b.Name),
+			Routes: []*route.Route{
+				{
+					Match: &route.RouteMatch{
+						PathSpecifier: &route.RouteMatch_Prefix{
+							Prefix: "/",
 						},
 					},
-				}
-				httpVirtualHosts = append(httpVirtualHosts, httpVirtualHost)
-			} else if t == EdgeTraffic || t == ReencryptTraffic {
-				httpsVirtualHost := &route.VirtualHost{
-					Name:    b.Name,
-					Domains: []string{fmt.Sprintf("%s:%d", b.Name, proxyHttpsPort), b.Name},
-					Routes: []*route.Route{
-						{
-							Match: &route.RouteMatch{
-								PathSpecifier: &route.RouteMatch_Prefix{
-									Prefix: "/",
-								},
-							},
-							Action: &route.Route_Route{
-								Route: &route.RouteAction{
-									ClusterSpecifier: &route.RouteAction_Cluster{
-										Cluster: b.Name,
-									},
-								},
+					Action: &route.Route_Route{
+						Route: &route.RouteAction{
+							ClusterSpecifier: &route.RouteAction_Cluster{
+								Cluster: b.Name,
 							},
 						},
 					},
-				}
-				httpsVirtualHosts = append(httpsVirtualHosts, httpsVirtualHost)
-			} else if t == PassthroughTraffic {
-				tcpProxy := &tcpproxy.TcpProxy{
-					StatPrefix: "ingress_http",
-					ClusterSpecifier: &tcpproxy.TcpProxy_Cluster{
-						Cluster: b.Name,
-					},
-				}
-				passthroughFilterChain := &listenerv3.FilterChain{
-					Filters: []*listenerv3.Filter{{
-						Name: b.Name,
-						ConfigType: &listenerv3.Filter_TypedConfig{
-							TypedConfig: convertToProtobuf(tcpProxy),
-						},
-					}},
-					FilterChainMatch: &listenerv3.FilterChainMatch{
-						ServerNames: []string{b.Name},
-					},
-				}
-				passthroughFilterChains = append(passthroughFilterChains, passthroughFilterChain)
-			}
+				},
+			},
+		}
+	}
 
-			cluster := &cluster.Cluster{
-				Name:                 b.Name,
-				ConnectTimeout:       ptypes.DurationProto(2 * time.Second),
-				ClusterDiscoveryType: &cluster.Cluster_Type{Type: cluster.Cluster_LOGICAL_DNS},
-				DnsLookupFamily:      cluster.Cluster_V4_ONLY,
-				LbPolicy:             cluster.Cluster_ROUND_ROBIN,
-				LoadAssignment: &endpoint.ClusterLoadAssignment{
-					ClusterName: b.Name,
-					Endpoints: []*endpoint.LocalityLbEndpoints{{
-						LbEndpoints: []*endpoint.LbEndpoint{
-							{
-								HostIdentifier: &endpoint.LbEndpoint_Endpoint{
-									Endpoint: &endpoint.Endpoint{
-										Address: &core.Address{
-											Address: &core.Address_SocketAddress{
-												SocketAddress: &core.SocketAddress{
-													Address:  b.ListenAddress,
-													Protocol: core.SocketAddress_TCP,
-													PortSpecifier: &core.SocketAddress_PortValue{
-														PortValue: uint32(b.Port),
-													},
-												},
-											},
-										},
+	newCluster := func(b BoundBackend, spec *TrafficTypeSpec) *cluster.Cluster {
+		var lbEndpoints []*endpoint.LbEndpoint
+		for _, e := range b.Endpoints {
+			lbEndpoints = append(lbEndpoints, &endpoint.LbEndpoint{
+				HostIdentifier: &endpoint.LbEndpoint_Endpoint{
+					Endpoint: &endpoint.Endpoint{
+						Address: &core.Address{
+							Address: &core.Address_SocketAddress{
+								SocketAddress: &core.SocketAddress{
+									Address:  e.ListenAddress,
+									Protocol: core.SocketAddress_TCP,
+									PortSpecifier: &core.SocketAddress_PortValue{
+										PortValue: uint32(e.Port),
 									},
 								},
 							},
 						},
-					}},
+					},
 				},
+			})
+		}
+
+		loadAssignment := &endpoint.ClusterLoadAssignment{
+			ClusterName: b.Name,
+			Endpoints: []*endpoint.LocalityLbEndpoints{{
+				LbEndpoints: lbEndpoints,
+			}},
+		}
+
+		// Endpoints are IP addresses; a LOGICAL_DNS cluster
+		// would also be limited to a single endpoint.
+		clusterType := cluster.Cluster_STATIC
+		var edsClusterConfig *cluster.Cluster_EdsClusterConfig
+		if c.DynamicResources {
+			// Endpoints are published separately so that
+			// endpoint changes don't churn the cluster.
+			clusterType = cluster.Cluster_EDS
+			edsClusterConfig = &cluster.Cluster_EdsClusterConfig{
+				EdsConfig: adsConfigSource(),
 			}
-			if t == ReencryptTraffic {
-				// Turns on termination for reencrypt clusters (backends) with the same certs used in the frontend
-				// termination.
-				upstreamTlsContext := &tlsv3.UpstreamTlsContext{
-					CommonTlsContext: commonHttpsTlsContext,
-				}
-				cluster.TransportSocket = &core.TransportSocket{
-					Name: wellknown.TransportSocketTLS,
-					ConfigType: &core.TransportSocket_TypedConfig{
-						TypedConfig: convertToProtobuf(upstreamTlsContext),
+			endpoints = append(endpoints, loadAssignment)
+		}
+
+		cluster := &cluster.Cluster{
+			Name:                 b.Name,
+			ConnectTimeout:       ptypes.DurationProto(2 * time.Second),
+			ClusterDiscoveryType: &cluster.Cluster_Type{Type: clusterType},
+			EdsClusterConfig:     edsClusterConfig,
+			LbPolicy:             cluster.Cluster_ROUND_ROBIN,
+			HealthChecks:         c.healthChecks(spec),
+		}
+		if !c.DynamicResources {
+			cluster.LoadAssignment = loadAssignment
+		}
+
+		clusters = append(clusters, cluster)
+		return cluster
+	}
+
+	err := routeBackends(backendsByTrafficType, func(b BoundBackend, spec *TrafficTypeSpec) error {
+		switch spec.PortRole {
+		case HTTPPortRole:
+			httpVirtualHosts = append(httpVirtualHosts, virtualHost(b, options.HTTPPort))
+		case HTTPSPortRole:
+			httpsVirtualHosts = append(httpsVirtualHosts, virtualHost(b, options.HTTPSPort, options.HTTPSPortSNIOnly))
+		case PassthroughPortRole:
+			tcpProxy := &tcpproxy.TcpProxy{
+				StatPrefix: "ingress_http",
+				ClusterSpecifier: &tcpproxy.TcpProxy_Cluster{
+					Cluster: b.Name,
+				},
+			}
+			passthroughFilterChain := &listenerv3.FilterChain{
+				Filters: []*listenerv3.Filter{{
+					Name: b.Name,
+					ConfigType: &listenerv3.Filter_TypedConfig{
+						TypedConfig: convertToProtobuf(tcpProxy),
 					},
-				}
+				}},
+				FilterChainMatch: &listenerv3.FilterChainMatch{
+					ServerNames: []string{b.Name},
+				},
 			}
+			passthroughFilterChains = append(passthroughFilterChains, passthroughFilterChain)
+		default:
+			return fmt.Errorf("%s: unsupported port role %q", spec.Name, spec.PortRole)
+		}
+
+		cluster := newCluster(b, spec)
 
-			clusters = append(clusters, cluster)
+		if spec.BackendTLS == BackendReencrypt {
+			// Turns on termination for reencrypt clusters (backends) with the same certs used in the frontend
+			// termination.
+			upstreamTlsContext := &tlsv3.UpstreamTlsContext{
+				CommonTlsContext: commonHttpsTlsContext,
+				Sni:              b.Name,
+			}
+			if c.EnableHTTP2 {
+				// Like HAProxy's "alpn h2,http/1.1", use
+				// whichever protocol the backend selects.
+				upstreamTlsContext.CommonTlsContext = proto.Clone(commonHttpsTlsContext).(*tlsv3.CommonTlsContext)
+				upstreamTlsContext.CommonTlsContext.AlpnProtocols = []string{"h2", "http/1.1"}
+				cluster.TypedExtensionProtocolOptions = map[string]*anypb.Any{
+					"envoy.extensions.upstreams.http.v3.HttpProtocolOptions": convertToProtobuf(&upstreamhttp.HttpProtocolOptions{
+						UpstreamProtocolOptions: &upstreamhttp.HttpProtocolOptions_AutoConfig{
+							AutoConfig: &upstreamhttp.HttpProtocolOptions_AutoHttpConfig{
+								Http2ProtocolOptions: &core.Http2ProtocolOptions{},
+							},
+						},
+					}),
+				}
+			}
+			cluster.TransportSocket = &core.TransportSocket{
+				Name: wellknown.TransportSocketTLS,
+				ConfigType: &core.TransportSocket_TypedConfig{
+					TypedConfig: convertToProtobuf(upstreamTlsContext),
+				},
+			}
 		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	httpRouteConfig := &route.RouteConfiguration{
+		Name:         "local_http_route",
+		VirtualHosts: httpVirtualHosts,
 	}
 
 	httpManager := &hcm.HttpConnectionManager{
 		CodecType:  hcm.HttpConnectionManager_AUTO,
 		StatPrefix: "ingress_http",
-		RouteSpecifier: &hcm.HttpConnectionManager_RouteConfig{
-			RouteConfig: &route.RouteConfiguration{
-				Name:         "local_http_route",
-				VirtualHosts: httpVirtualHosts,
-			},
-		},
 		HttpFilters: []*hcm.HttpFilter{{
 			Name: wellknown.Router,
 			ConfigType: &hcm.HttpFilter_TypedConfig{
@@ -301,6 +573,7 @@ func (c *SyncEnvoyConfigCmd) Run(p *ProgramCtx) error {
 		}},
 		AccessLog: commonAccessLog,
 	}
+	c.setRouteConfig(httpManager, httpRouteConfig)
 
 	listenerHttp := listenerv3.Listener{
 		Name: "listener_http",
@@ -310,7 +583,7 @@ func (c *SyncEnvoyConfigCmd) Run(p *ProgramCtx) error {
 					Protocol: core.SocketAddress_TCP,
 					Address:  c.ListenAddress,
 					PortSpecifier: &core.SocketAddress_PortValue{
-						PortValue: proxyHttpPort,
+						PortValue: options.HTTPPort,
 					},
 				},
 			},
@@ -328,15 +601,14 @@ func (c *SyncEnvoyConfigCmd) Run(p *ProgramCtx) error {
 		},
 	}
 
+	httpsRouteConfig := &route.RouteConfiguration{
+		Name:         "local_https_route",
+		VirtualHosts: httpsVirtualHosts,
+	}
+
 	httpsManager := &hcm.HttpConnectionManager{
 		CodecType:  hcm.HttpConnectionManager_AUTO,
 		StatPrefix: "ingress_http",
-		RouteSpecifier: &hcm.HttpConnectionManager_RouteConfig{
-			RouteConfig: &route.RouteConfiguration{
-				Name:         "local_https_route",
-				VirtualHosts: httpsVirtualHosts,
-			},
-		},
 		HttpFilters: []*hcm.HttpFilter{{
 			Name: wellknown.Router,
 			ConfigType: &hcm.HttpFilter_TypedConfig{
@@ -345,6 +617,15 @@ func (c *SyncEnvoyConfigCmd) Run(p *ProgramCtx) error {
 		}},
 		AccessLog: commonAccessLog,
 	}
+	c.setRouteConfig(httpsManager, httpsRouteConfig)
+
+	downstreamTlsContext := &tlsv3.DownstreamTlsContext{
+		CommonTlsContext: commonHttpsTlsContext,
+	}
+	if c.EnableHTTP2 {
+		downstreamTlsContext.CommonTlsContext = proto.Clone(commonHttpsTlsContext).(*tlsv3.CommonTlsContext)
+		downstreamTlsContext.CommonTlsContext.AlpnProtocols = []string{"h2", "http/1.1"}
+	}
 
 	// Edge and reencrypt are one their own filter chain inside the 8443 listener
 	// Traffic gets routed by matching the hostname under the Virtual Host object (just like our 8080 http listener)
@@ -358,9 +639,7 @@ func (c *SyncEnvoyConfigCmd) Run(p *ProgramCtx) error {
 		TransportSocket: &core.TransportSocket{
 			Name: wellknown.TransportSocketTLS,
 			ConfigType: &core.TransportSocket_TypedConfig{
-				TypedConfig: convertToProtobuf(&tlsv3.DownstreamTlsContext{
-					CommonTlsContext: commonHttpsTlsContext,
-				}),
+				TypedConfig: convertToProtobuf(downstreamTlsContext),
 			},
 		},
 	}
@@ -376,7 +655,7 @@ func (c *SyncEnvoyConfigCmd) Run(p *ProgramCtx) error {
 					Protocol: core.SocketAddress_TCP,
 					Address:  c.ListenAddress,
 					PortSpecifier: &core.SocketAddress_PortValue{
-						PortValue: proxyHttpsPort,
+						PortValue: options.HTTPSPort,
 					},
 				},
 			},
@@ -393,51 +672,112 @@ func (c *SyncEnvoyConfigCmd) Run(p *ProgramCtx) error {
 		},
 	}
 
-	listeners = append(listeners, &listenerHttp, &listenerHttps)
-
-	// Use a random version just so it's different everytime; otherwise, Envoy won't effectuate the snapshot.
-	var seededRand *rand.Rand = rand.New(
-		rand.NewSource(time.Now().UnixNano()))
+	// The SNI-only listener terminates TLS for edge and reencrypt
+	// routes directly, like HAProxy's public_ssl_sni_only
+	// frontend, without first inspecting for passthrough routes.
+	listenerHttpsSNIOnly := listenerv3.Listener{
+		Name: "listener_https_sni_only",
+		Address: &core.Address{
+			Address: &core.Address_SocketAddress{
+				SocketAddress: &core.SocketAddress{
+					Protocol: core.SocketAddress_TCP,
+					Address:  c.ListenAddress,
+					PortSpecifier: &core.SocketAddress_PortValue{
+						PortValue: options.HTTPSPortSNIOnly,
+					},
+				},
+			},
+		},
+		AccessLog:    commonAccessLog,
+		FilterChains: []*listenerv3.FilterChain{edgeReencryptFilterChain},
+	}
 
-	version := seededRand.Int31()
-	log.Printf("Creating snapshot Version " + fmt.Sprint(version))
+	listeners = append(listeners, &listenerHttp, &listenerHttps, &listenerHttpsSNIOnly)
 
-	resources := make(map[string][]types.Resource, 3)
+	resources := make(map[string][]types.Resource, 4)
 
 	resources[resource.ClusterType] = clusters
 	resources[resource.ListenerType] = listeners
-	snap, err := cachev3.NewSnapshot(fmt.Sprint(version), resources)
-	if err != nil {
-		log.Fatalf("Could not set snapshot %v", err)
+
+	if c.DynamicResources {
+		resources[resource.EndpointType] = endpoints
+		resources[resource.RouteType] = []types.Resource{httpRouteConfig, httpsRouteConfig}
 	}
-	if err := snap.Consistent(); err != nil {
-		log.Printf("snapshot inconsistency: %+v\n%+v", snap, err)
-		os.Exit(1)
+
+	return resources, nil
+}
+
+// healthChecks mirrors HAProxy's "check inter" with HAProxy's
+// default rise and fall counts: a GET of HealthCheckPath, if it is
+// set, for routes HAProxy checks with "option httpchk", otherwise a
+// connect (and, for reencrypt, TLS handshake) check.
+func (c *SyncEnvoyConfigCmd) healthChecks(spec *TrafficTypeSpec) []*core.HealthCheck {
+	healthCheck := &core.HealthCheck{
+		Timeout:            ptypes.DurationProto(5 * time.Second),
+		Interval:           ptypes.DurationProto(time.Duration(c.HealthCheckIntervalInMillis) * time.Millisecond),
+		UnhealthyThreshold: wrapperspb.UInt32(3),
+		HealthyThreshold:   wrapperspb.UInt32(2),
+		HealthChecker: &core.HealthCheck_TcpHealthCheck_{
+			TcpHealthCheck: &core.HealthCheck_TcpHealthCheck{},
+		},
 	}
-	err = cache.SetSnapshot(ctx, nodeId, snap)
-	if err != nil {
-		log.Fatalf("Could not set snapshot %v", err)
+	if c.HealthCheckPath != "" && spec.PortRole != PassthroughPortRole {
+		healthCheck.HealthChecker = &core.HealthCheck_HttpHealthCheck_{
+			HttpHealthCheck: &core.HealthCheck_HttpHealthCheck{
+				Path: c.HealthCheckPath,
+			},
+		}
 	}
+	return []*core.HealthCheck{healthCheck}
+}
 
-	for !cb.allResponsesSent() {
-		log.Printf("Waiting for Envoy to sync...")
-		time.Sleep(1 * time.Second)
+// adsConfigSource directs Envoy to fetch a resource over the
+// aggregated discovery stream.
+func adsConfigSource() *core.ConfigSource {
+	return &core.ConfigSource{
+		ResourceApiVersion: core.ApiVersion_V3,
+		ConfigSourceSpecifier: &core.ConfigSource_Ads{
+			Ads: &core.AggregatedConfigSource{},
+		},
 	}
+}
 
-	return nil
+// setRouteConfig embeds routeConfig in manager or, with
+// --dynamic-resources, refers to it by name over RDS.
+func (c *SyncEnvoyConfigCmd) setRouteConfig(manager *hcm.HttpConnectionManager, routeConfig *route.RouteConfiguration) {
+	if !c.DynamicResources {
+		manager.RouteSpecifier = &hcm.HttpConnectionManager_RouteConfig{
+			RouteConfig: routeConfig,
+		}
+		return
+	}
+	manager.RouteSpecifier = &hcm.HttpConnectionManager_Rds{
+		Rds: &hcm.Rds{
+			ConfigSource:    adsConfigSource(),
+			RouteConfigName: routeConfig.Name,
+		},
+	}
 }
 
-func (cb *Callbacks) allResponsesSent() bool {
-	clusterResponse := false
-	listenerResponse := false
-	for _, resp := range cb.Responses {
-		if resp.TypeUrl == "type.googleapis.com/envoy.config.cluster.v3.Cluster" {
-			clusterResponse = true
-		} else if resp.TypeUrl == "type.googleapis.com/envoy.config.listener.v3.Listener" {
-			listenerResponse = true
+func (cb *Callbacks) allResponsesSent(typeURLs []string) bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	for _, typeURL := range typeURLs {
+		if !cb.Responded[typeURL] {
+			return false
 		}
 	}
-	return clusterResponse && listenerResponse
+	return true
+}
+
+// snapshotSet must be called before the snapshot is given to the
+// cache.
+func (cb *Callbacks) snapshotSet(version string) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.snapshotVersion = version
+	cb.snapshotTime = time.Now()
+	cb.acked = map[string]bool{}
 }
 
 const grpcMaxConcurrentStreams = 1000000
@@ -489,12 +829,46 @@ func (cb *Callbacks) OnStreamOpen(_ context.Context, id int64, typ string) error
 }
 func (cb *Callbacks) OnStreamClosed(id int64) {
 	//log.Printf("OnStreamClosed %d closed", id)
+	cb.mu.Lock()
+	nodeID, known := cb.streamNodes[id]
+	delete(cb.streamNodes, id)
+	for _, other := range cb.streamNodes {
+		if other == nodeID {
+			// The node has reconnected on another stream.
+			known = false
+		}
+	}
+	cb.mu.Unlock()
+
+	if known && cb.OnNodeClosed != nil {
+		cb.OnNodeClosed(nodeID)
+	}
 }
 func (cb *Callbacks) OnStreamRequest(id int64, r *discoverygrpc.DiscoveryRequest) error {
 	log.Printf("Envoy Requested: %v", r.TypeUrl)
+
+	cb.mu.Lock()
+	_, known := cb.streamNodes[id]
+	if !known && r.Node != nil {
+		cb.streamNodes[id] = r.Node.GetId()
+	}
+	cb.mu.Unlock()
+
+	// Give the node its snapshot before the server looks for one.
+	if !known && r.Node != nil && cb.OnNode != nil {
+		cb.OnNode(r.Node)
+	}
+
 	cb.mu.Lock()
 	defer cb.mu.Unlock()
 	cb.Requests++
+	nodeId := cb.streamNodes[id]
+	if r.ErrorDetail != nil {
+		log.Printf("Envoy %s rejected %v version %v: %v", nodeId, r.TypeUrl, cb.snapshotVersion, r.ErrorDetail.Message)
+	} else if key := nodeId + " " + r.TypeUrl; cb.snapshotVersion != "" && r.VersionInfo == cb.snapshotVersion && !cb.acked[key] {
+		cb.acked[key] = true
+		log.Printf("Envoy %s acknowledged %v version %v after %v", nodeId, r.TypeUrl, r.VersionInfo, time.Since(cb.snapshotTime))
+	}
 	if cb.Signal != nil {
 		close(cb.Signal)
 		cb.Signal = nil
@@ -503,7 +877,9 @@ func (cb *Callbacks) OnStreamRequest(id int64, r *discoverygrpc.DiscoveryRequest
 }
 func (cb *Callbacks) OnStreamResponse(ctx context.Context, id int64, req *discoverygrpc.DiscoveryRequest, resp *discoverygrpc.DiscoveryResponse) {
 	log.Printf("Responding: %d Request [%v],  Response[%v]", id, req.TypeUrl, resp.TypeUrl)
-	cb.Responses = append(cb.Responses, resp)
+	cb.mu.Lock()
+	cb.Responded[resp.TypeUrl] = true
+	cb.mu.Unlock()
 	cb.Report()
 }
 
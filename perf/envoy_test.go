@@ -0,0 +1,177 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	clusterv3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	listenerv3 "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	tlsv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	discoverygrpc "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+)
+
+func TestEnvoyResources(t *testing.T) {
+	backendsByTrafficType := BoundBackendsByTrafficType{}
+	for _, trafficType := range AllTrafficTypes {
+		for i, port := range []int{10000, 10001} {
+			backendsByTrafficType[trafficType] = append(backendsByTrafficType[trafficType], BoundBackend{
+				Backend: Backend{
+					Name:        string(trafficType) + "-" + string(rune('0'+i)),
+					TrafficType: trafficType,
+				},
+				Endpoints: []Endpoint{
+					{ListenAddress: "127.0.0.1", Port: port},
+					{ListenAddress: "127.0.0.1", Port: port + 100},
+				},
+			})
+		}
+	}
+
+	options := envoyNodeOptions{
+		HTTPPort:         8080,
+		HTTPSPort:        8443,
+		HTTPSPortSNIOnly: 9443,
+		Shard:            0,
+		Shards:           1,
+	}
+
+	for _, dynamicResources := range []bool{false, true} {
+		c := SyncEnvoyConfigCmd{
+			EnvoyConfig: EnvoyConfig{
+				EnableHTTP2:                 true,
+				HealthCheckIntervalInMillis: 1000,
+				HealthCheckPath:             "/healthz",
+				ListenAddress:               "127.0.0.1",
+			},
+			DynamicResources: dynamicResources,
+		}
+
+		certs := envoyCertificatesInline(&Certificates{
+			LeafCertPEM:   "leaf-cert",
+			LeafKeyPEM:    "leaf-key",
+			RootCACertPEM: "root-ca",
+		})
+		resources, err := c.resources(backendsByTrafficType, certs, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for typeURL, rs := range resources {
+			for _, r := range rs {
+				if v, ok := r.(interface{ ValidateAll() error }); ok {
+					if err := v.ValidateAll(); err != nil {
+						t.Errorf("dynamic=%v: %s: %v", dynamicResources, typeURL, err)
+					}
+				}
+			}
+		}
+
+		if got := len(resources[resource.ClusterType]); got != 8 {
+			t.Errorf("dynamic=%v: expected 8 clusters, got %d", dynamicResources, got)
+		}
+
+		ports := map[uint32]bool{}
+		for _, r := range resources[resource.ListenerType] {
+			l := r.(*listenerv3.Listener)
+			port := l.GetAddress().GetSocketAddress().GetPortValue()
+			ports[port] = true
+			// A snapshot for a reissued certificate must
+			// carry its bytes.
+			for _, fc := range l.GetFilterChains() {
+				if fc.GetTransportSocket() == nil {
+					continue
+				}
+				var tlsContext tlsv3.DownstreamTlsContext
+				if err := fc.GetTransportSocket().GetTypedConfig().UnmarshalTo(&tlsContext); err != nil {
+					t.Fatal(err)
+				}
+				if got := tlsContext.GetCommonTlsContext().GetTlsCertificates()[0].GetCertificateChain().GetInlineString(); got != "leaf-cert" {
+					t.Errorf("dynamic=%v: port %d: expected the certificate inline, got %q", dynamicResources, port, got)
+				}
+			}
+		}
+		for _, port := range []uint32{8080, 8443, 9443} {
+			if !ports[port] {
+				t.Errorf("dynamic=%v: no listener on port %d", dynamicResources, port)
+			}
+		}
+
+		if dynamicResources && len(resources[resource.EndpointType]) != 8 {
+			t.Errorf("expected 8 endpoints, got %d", len(resources[resource.EndpointType]))
+		}
+
+		for _, r := range resources[resource.ClusterType] {
+			c := r.(*clusterv3.Cluster)
+			httpCheck := c.GetHealthChecks()[0].GetHttpHealthCheck()
+			if passthrough := strings.HasPrefix(c.Name, string(PassthroughTraffic)); passthrough != (httpCheck == nil) {
+				t.Errorf("%s: unexpected health check %v", c.Name, c.GetHealthChecks()[0])
+			} else if httpCheck != nil && httpCheck.GetPath() != "/healthz" {
+				t.Errorf("%s: expected a check of /healthz, got %v", c.Name, httpCheck)
+			}
+			if dynamicResources {
+				continue
+			}
+			if got := len(c.GetLoadAssignment().GetEndpoints()[0].GetLbEndpoints()); got != 2 {
+				t.Errorf("%s: expected 2 endpoints, got %d", c.Name, got)
+			}
+		}
+	}
+}
+
+func TestEnvoyNodeOptionsShard(t *testing.T) {
+	backendsByTrafficType := BoundBackendsByTrafficType{
+		HTTPTraffic: {
+			{Backend: Backend{Name: "http-0"}},
+			{Backend: Backend{Name: "http-1"}},
+			{Backend: Backend{Name: "http-2"}},
+		},
+	}
+
+	shard := envoyNodeOptions{Shard: 1, Shards: 2}.shard(backendsByTrafficType)
+	if len(shard[HTTPTraffic]) != 1 || shard[HTTPTraffic][0].Name != "http-1" {
+		t.Errorf("unexpected shard %+v", shard)
+	}
+}
+
+func TestCallbacksNodeClosed(t *testing.T) {
+	var opened, closed []string
+	cb := &Callbacks{
+		Responded:   map[string]bool{},
+		streamNodes: map[int64]string{},
+		acked:       map[string]bool{},
+		OnNode: func(node *core.Node) {
+			opened = append(opened, node.GetId())
+		},
+		OnNodeClosed: func(nodeID string) {
+			closed = append(closed, nodeID)
+		},
+	}
+
+	request := func(stream int64, nodeID string) {
+		if err := cb.OnStreamRequest(stream, &discoverygrpc.DiscoveryRequest{Node: &core.Node{Id: nodeID}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	request(1, "envoy-1")
+	request(1, "envoy-1")
+	request(2, "envoy-2")
+	// envoy-1 reconnects before its first stream is closed.
+	request(3, "envoy-1")
+
+	cb.OnStreamClosed(1)
+	if len(closed) != 0 {
+		t.Errorf("expected envoy-1 to be kept while it has a stream, got %v", closed)
+	}
+	cb.OnStreamClosed(2)
+	cb.OnStreamClosed(3)
+
+	if strings.Join(opened, " ") != "envoy-1 envoy-2 envoy-1" {
+		t.Errorf("unexpected nodes opened %v", opened)
+	}
+	if strings.Join(closed, " ") != "envoy-2 envoy-1" {
+		t.Errorf("unexpected nodes closed %v", closed)
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// detectionQuietPeriod is how long the proxy must have stopped
+// routing to a failed endpoint, before it is restored, for the
+// failure to count as detected.
+const detectionQuietPeriod = time.Second
+
+// failoverFaults are the ways FailoverCmd can take an endpoint down.
+var failoverFaults = map[string]Faults{
+	"refuse":       {RefuseConnections: true},
+	"health-check": {FailHealthChecks: true},
+	"hang":         {Hang: true},
+}
+
+type probeResult struct {
+	sent     time.Time
+	latency  time.Duration
+	endpoint string
+	status   int
+	err      error
+}
+
+func (r *probeResult) failed() bool {
+	return r.err != nil || r.status != http.StatusOK
+}
+
+// failoverReport is what the probes saw of an endpoint failing and
+// being restored.
+type failoverReport struct {
+	// Probes is the number of probes sent while the endpoint was
+	// down; Failed of them errored or had a bad status, and
+	// ServedByFailed were served by the failed endpoint.
+	Probes         int
+	Failed         int
+	ServedByFailed int
+
+	// MaxLatency is the slowest of those probes, which shows
+	// what retrying (or redispatching) requests to the failed
+	// endpoint cost, when that hid the failure from clients.
+	MaxLatency time.Duration
+
+	// Detection is the time from the endpoint failing to the
+	// last probe sent that was served by it or failed.
+	Detection time.Duration
+	Detected  bool
+
+	// Recovery is the time from the endpoint being restored to
+	// the first probe it served.
+	Recovery  time.Duration
+	Recovered bool
+}
+
+// analyseFailover reports on probes of a route, some of which may
+// have been served by endpoint, which failed at injected and was
+// restored at restored.
+func analyseFailover(probes []*probeResult, endpoint string, injected, restored time.Time) failoverReport {
+	var report failoverReport
+	var lastAffected time.Time
+
+	for _, r := range probes {
+		switch {
+		case r.sent.Before(injected):
+		case r.sent.Before(restored):
+			report.Probes += 1
+			if r.latency > report.MaxLatency {
+				report.MaxLatency = r.latency
+			}
+			if r.failed() {
+				report.Failed += 1
+			} else if r.endpoint == endpoint {
+				report.ServedByFailed += 1
+			}
+			if (r.failed() || r.endpoint == endpoint) && r.sent.After(lastAffected) {
+				lastAffected = r.sent
+			}
+		default:
+			if r.failed() || r.endpoint != endpoint {
+				continue
+			}
+			if d := r.sent.Sub(restored); !report.Recovered || d < report.Recovery {
+				report.Recovery = d
+				report.Recovered = true
+			}
+		}
+	}
+
+	if !lastAffected.IsZero() {
+		report.Detection = lastAffected.Sub(injected)
+	}
+	report.Detected = restored.Sub(injected)-report.Detection >= detectionQuietPeriod
+
+	return report
+}
+
+func (r failoverReport) write(w io.Writer) error {
+	detection, recovery := "not detected", "not recovered"
+	if r.Detected {
+		detection = r.Detection.String()
+	}
+	if r.Recovered {
+		recovery = r.Recovery.String()
+	}
+	_, err := fmt.Fprintf(w, "detection: %v probes: %v failed: %v served_by_failed: %v max_latency: %v\nrecovery: %v\n",
+		detection, r.Probes, r.Failed, r.ServedByFailed, r.MaxLatency, recovery)
+	return err
+}
+
+// failoverTarget returns the backend to fail and the URL its route
+// is probed at through the proxy.
+func (c *FailoverCmd) failoverTarget(p *ProgramCtx) (BoundBackend, string, error) {
+	spec, err := lookupTrafficType(c.TrafficType)
+	if err != nil {
+		return BoundBackend{}, "", err
+	}
+
+	backendsByTrafficType, err := fetchAllBackendMetadata(p.DiscoveryURL)
+	if err != nil {
+		return BoundBackend{}, "", err
+	}
+
+	for _, b := range backendsByTrafficType[c.TrafficType] {
+		if c.Backend != "" && b.Name != c.Backend {
+			continue
+		}
+		if len(b.Endpoints) < 2 {
+			return BoundBackend{}, "", fmt.Errorf("%s has %d endpoint(s) and nothing to fail over to; run serve-backends with --replicas 2 or more", b.Name, len(b.Endpoints))
+		}
+		if c.Replica < 0 || c.Replica >= len(b.Endpoints) {
+			return BoundBackend{}, "", fmt.Errorf("%s has no replica %d", b.Name, c.Replica)
+		}
+		url := fmt.Sprintf("%s://%s:%v/1024.html", spec.Scheme, b.Name, haproxyPortSelector(b, p.Globals)[0])
+		return b, url, nil
+	}
+
+	return BoundBackend{}, "", fmt.Errorf("no %s backend %q", c.TrafficType, c.Backend)
+}
+
+// probe requests url every interval until ctx is done, sending the
+// results to resultCh. Probes are sent on new connections and
+// concurrently, so that one that hangs does not hold back the next.
+func probe(ctx context.Context, url string, interval, timeout time.Duration, resultCh chan<- *probeResult) {
+	client := newHTTPClient(false)
+	client.Timeout = timeout
+	client.Transport.(*http.Transport).DisableKeepAlives = true
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case sent := <-ticker.C:
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				result := &probeResult{sent: sent}
+				resp, err := client.Get(url)
+				if err == nil {
+					_, err = io.Copy(io.Discard, resp.Body)
+					resp.Body.Close()
+					result.status = resp.StatusCode
+					result.endpoint = resp.Header.Get(BackendEndpointHeader)
+				}
+				result.err = err
+				result.latency = time.Since(sent)
+				resultCh <- result
+			}()
+		}
+	}
+}
+
+func (c *FailoverCmd) Run(p *ProgramCtx) error {
+	return c.run(p, os.Stdout)
+}
+
+// run takes a backend endpoint down and brings it back while probing
+// its route through the proxy, and writes a failoverReport to out.
+func (c *FailoverCmd) run(p *ProgramCtx, out io.Writer) error {
+	b, url, err := c.failoverTarget(p)
+	if err != nil {
+		return err
+	}
+
+	endpoint := backendEndpointID(b.Name, c.Replica)
+	setFaults := func(faults Faults) error {
+		return injectFaults(p.DiscoveryURL, InjectFaultsRequest{
+			Names: []string{b.Name},
+			EndpointFaults: EndpointFaults{
+				Replicas: []int{c.Replica},
+				Faults:   faults,
+			},
+		})
+	}
+
+	if err := setFaults(Faults{}); err != nil {
+		return err
+	}
+	// However the run ends, leave the endpoint up.
+	defer func() {
+		if err := setFaults(Faults{}); err != nil {
+			log.Printf("restoring %s: %v", endpoint, err)
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(p.Context)
+	defer cancel()
+
+	resultCh := make(chan *probeResult)
+	probed := make(chan struct{})
+
+	go func() {
+		probe(ctx, url, c.ProbeInterval, c.ProbeTimeout, resultCh)
+		close(probed)
+	}()
+
+	var (
+		probes    []*probeResult
+		injected  time.Time
+		restored  time.Time
+		recovered bool
+	)
+
+	// stopProbing collects the probes still in flight, which
+	// would otherwise block probe from returning, however the run
+	// ends.
+	stopProbing := func() {
+		cancel()
+		for {
+			select {
+			case result := <-resultCh:
+				probes = append(probes, result)
+			case <-probed:
+				return
+			}
+		}
+	}
+	defer stopProbing()
+
+	phase := time.After(c.Warmup)
+	log.Printf("probing %s; %s is up", url, endpoint)
+
+	for {
+		select {
+		case <-p.Context.Done():
+			return errors.New("failover interrupted")
+
+		case result := <-resultCh:
+			probes = append(probes, result)
+			if !restored.IsZero() && !recovered && result.sent.After(restored) && !result.failed() && result.endpoint == endpoint {
+				recovered = true
+				phase = time.After(0)
+			}
+			continue
+
+		case <-phase:
+		}
+
+		switch {
+		case injected.IsZero():
+			served := 0
+			for _, r := range probes {
+				if r.endpoint == endpoint {
+					served += 1
+				}
+			}
+			if served == 0 {
+				return fmt.Errorf("%s served none of %d probes before failing it", endpoint, len(probes))
+			}
+			injected = time.Now()
+			if err := setFaults(failoverFaults[c.Fault]); err != nil {
+				return err
+			}
+			log.Printf("%s is down (%s)", endpoint, c.Fault)
+			phase = time.After(c.Down)
+
+		case restored.IsZero():
+			restored = time.Now()
+			if err := setFaults(Faults{}); err != nil {
+				return err
+			}
+			log.Printf("%s is up", endpoint)
+			phase = time.After(c.RecoveryTimeout)
+
+		default:
+			stopProbing()
+			if _, err := fmt.Fprintf(out, "failover: %s fault: %s\n", endpoint, c.Fault); err != nil {
+				return err
+			}
+			return analyseFailover(probes, endpoint, injected, restored).write(out)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAnalyseFailover(t *testing.T) {
+	start := time.Now()
+	at := func(ms int) time.Time {
+		return start.Add(time.Duration(ms) * time.Millisecond)
+	}
+
+	injected, restored := at(1000), at(5000)
+
+	probes := []*probeResult{
+		{sent: at(0), endpoint: "b/0", status: 200},
+		{sent: at(500), endpoint: "b/1", status: 200},
+		// Still routed to the failed endpoint until 1500ms.
+		{sent: at(1100), endpoint: "b/0", status: 200},
+		{sent: at(1200), err: errors.New("connection refused"), latency: 3 * time.Millisecond},
+		{sent: at(1500), status: 503, latency: 5 * time.Millisecond},
+		{sent: at(2000), endpoint: "b/1", status: 200},
+		{sent: at(4900), endpoint: "b/1", status: 200},
+		// Back from 5300ms.
+		{sent: at(5100), endpoint: "b/1", status: 200},
+		{sent: at(5200), endpoint: "b/0", status: 503},
+		{sent: at(5400), endpoint: "b/0", status: 200},
+		{sent: at(5300), endpoint: "b/0", status: 200},
+	}
+
+	report := analyseFailover(probes, "b/0", injected, restored)
+
+	expected := failoverReport{
+		Probes:         5,
+		Failed:         2,
+		ServedByFailed: 1,
+		MaxLatency:     5 * time.Millisecond,
+		Detection:      500 * time.Millisecond,
+		Detected:       true,
+		Recovery:       300 * time.Millisecond,
+		Recovered:      true,
+	}
+	if report != expected {
+		t.Errorf("expected %+v, got %+v", expected, report)
+	}
+
+	// Failing up to the restore is not detection.
+	probes = append(probes, &probeResult{sent: at(4500), err: errors.New("timeout")})
+	if report := analyseFailover(probes, "b/0", injected, restored); report.Detected {
+		t.Errorf("expected no detection, got %+v", report)
+	}
+
+	if report := analyseFailover(probes[:7], "b/0", injected, restored); report.Recovered {
+		t.Errorf("expected no recovery, got %+v", report)
+	}
+}
+
+func TestFailoverTargetNeedsReplicas(t *testing.T) {
+	backendsByTrafficType := testTopology()
+	backendsByTrafficType[HTTPTraffic][0].Endpoints = backendsByTrafficType[HTTPTraffic][0].Endpoints[:1]
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(backendsByTrafficType)
+	}))
+	defer server.Close()
+
+	p := &ProgramCtx{Globals: Globals{DiscoveryURL: server.URL}}
+
+	c := &FailoverCmd{TrafficType: HTTPTraffic}
+	if _, _, err := c.failoverTarget(p); err == nil || !strings.Contains(err.Error(), "--replicas") {
+		t.Errorf("expected a single endpoint backend to be rejected, got %v", err)
+	}
+
+	c.TrafficType = EdgeTraffic
+	if b, _, err := c.failoverTarget(p); err != nil || b.Name != backendsByTrafficType[EdgeTraffic][0].Name {
+		t.Errorf("expected %s, got %s, %v", backendsByTrafficType[EdgeTraffic][0].Name, b.Name, err)
+	}
+}
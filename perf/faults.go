@@ -0,0 +1,379 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// HealthCheckPath is where backends answer HTTP health checks.
+const HealthCheckPath = "/healthz"
+
+// Faults are the failures an endpoint injects. The zero value
+// injects none.
+type Faults struct {
+	// FailHealthChecks answers requests for HealthCheckPath with
+	// 503 Service Unavailable.
+	FailHealthChecks bool `json:"fail_health_checks,omitempty"`
+
+	// Latency is added before every response.
+	Latency specDuration `json:"latency,omitempty"`
+
+	// ErrorPercent of responses are 503 Service Unavailable.
+	ErrorPercent float64 `json:"error_percent,omitempty"`
+
+	// ResetPercent of responses are abandoned part way through
+	// by resetting the connection.
+	ResetPercent float64 `json:"reset_percent,omitempty"`
+
+	// RefuseConnections resets the endpoint's connections and
+	// closes its listening socket so that new connections are
+	// refused, as if it had gone away.
+	RefuseConnections bool `json:"refuse_connections,omitempty"`
+
+	// Hang never responds, holding requests until the client
+	// gives up.
+	Hang bool `json:"hang,omitempty"`
+}
+
+// EndpointFaults sets the faults of a backend's replicas, or of all
+// of them if Replicas is empty. Faults replace those already set.
+type EndpointFaults struct {
+	Replicas []int  `json:"replicas,omitempty"`
+	Faults   Faults `json:"faults"`
+}
+
+// InjectFaultsRequest is the body of a POST to /backends/faults.
+// The faults are sent to the backends in Names or, if there are
+// none, to every backend of TrafficType.
+type InjectFaultsRequest struct {
+	Names       []string    `json:"names,omitempty"`
+	TrafficType TrafficType `json:"traffic_type,omitempty"`
+
+	EndpointFaults
+}
+
+// BackendRegistration is the body of a POST to /register. ControlURL
+// is where the backend accepts EndpointFaults.
+type BackendRegistration struct {
+	BoundBackend
+
+	ControlURL string `json:"control_url"`
+}
+
+var errInjectedReset = errors.New("injected connection reset")
+
+// backendFaults holds the faults injected by each of a backend's
+// replicas.
+type backendFaults struct {
+	mu        sync.RWMutex
+	faults    []Faults
+	listeners []*refusingListener
+}
+
+// newBackendFaults returns the faults of a backend served on
+// listeners, and the listeners to serve each replica on in their
+// place.
+func newBackendFaults(listeners []net.Listener) (*backendFaults, []net.Listener) {
+	f := &backendFaults{
+		faults: make([]Faults, len(listeners)),
+	}
+	var result []net.Listener
+	for _, l := range listeners {
+		rl := newRefusingListener(l)
+		f.listeners = append(f.listeners, rl)
+		result = append(result, rl)
+	}
+	return f, result
+}
+
+func (f *backendFaults) get(replica int) Faults {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.faults[replica]
+}
+
+func (f *backendFaults) all() []Faults {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return append([]Faults(nil), f.faults...)
+}
+
+func (f *backendFaults) set(ef EndpointFaults) error {
+	if ef.Faults.ErrorPercent < 0 || ef.Faults.ErrorPercent > 100 || ef.Faults.ResetPercent < 0 || ef.Faults.ResetPercent > 100 {
+		return fmt.Errorf("percentages must be between 0 and 100: %+v", ef.Faults)
+	}
+	if ef.Faults.Latency < 0 {
+		return fmt.Errorf("invalid latency: %v", time.Duration(ef.Faults.Latency))
+	}
+
+	replicas := ef.Replicas
+	if len(replicas) == 0 {
+		for i := range f.faults {
+			replicas = append(replicas, i)
+		}
+	}
+	for _, i := range replicas {
+		if i < 0 || i >= len(f.faults) {
+			return fmt.Errorf("no replica %d", i)
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, i := range replicas {
+		if err := f.listeners[i].refuse(ef.Faults.RefuseConnections); err != nil {
+			return err
+		}
+		f.faults[i] = ef.Faults
+	}
+
+	return nil
+}
+
+// handler injects replica's faults into the requests served by next.
+func (f *backendFaults) handler(replica int, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		faults := f.get(replica)
+
+		if faults.Hang {
+			<-r.Context().Done()
+			return
+		}
+
+		if faults.Latency > 0 {
+			select {
+			case <-time.After(time.Duration(faults.Latency)):
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+		if faults.FailHealthChecks && r.URL.Path == HealthCheckPath {
+			http.Error(w, "injected health check failure", http.StatusServiceUnavailable)
+			return
+		}
+
+		if faults.ErrorPercent > 0 && rand.Float64()*100 < faults.ErrorPercent {
+			http.Error(w, "injected error", http.StatusServiceUnavailable)
+			return
+		}
+
+		if faults.ResetPercent > 0 && rand.Float64()*100 < faults.ResetPercent {
+			rw := &resettingResponseWriter{ResponseWriter: w}
+			next.ServeHTTP(rw, r)
+			if !rw.reset {
+				resetConnection(w)
+			}
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// serveControl serves GET and POST of EndpointFaults.
+func (f *backendFaults) serveControl(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		writeJSON(w, f.all())
+		return
+	}
+	var request EndpointFaults
+	if !decodeJSONRequest(w, r, &request) {
+		return
+	}
+	if err := f.set(request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, f.all())
+}
+
+// resettingResponseWriter writes the header and half of the first
+// write of a response, and then resets the connection. A response
+// with less than that to write is reset before anything is sent.
+type resettingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	reset  bool
+}
+
+func (w *resettingResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *resettingResponseWriter) Write(p []byte) (int, error) {
+	if !w.reset {
+		w.reset = true
+		if half := p[:len(p)/2]; len(half) > 0 {
+			if w.status != 0 {
+				w.ResponseWriter.WriteHeader(w.status)
+			}
+			if _, err := w.ResponseWriter.Write(half); err != nil {
+				return 0, err
+			}
+			_ = http.NewResponseController(w.ResponseWriter).Flush()
+		}
+		resetConnection(w.ResponseWriter)
+	}
+	return 0, errInjectedReset
+}
+
+// resetConnection abandons a response by resetting its connection
+// or, where the connection cannot be taken over (HTTP/2), the
+// stream.
+func resetConnection(w http.ResponseWriter) {
+	conn, _, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		panic(http.ErrAbortHandler)
+	}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		// Skip the close_notify alert.
+		conn = tlsConn.NetConn()
+	}
+	if tc, ok := conn.(*trackedConn); ok {
+		tc.l.mu.Lock()
+		delete(tc.l.conns, tc)
+		tc.l.mu.Unlock()
+		conn = tc.Conn
+	}
+	resetConn(conn)
+}
+
+// refusingListener is a net.Listener whose socket can be closed, so
+// that connections to it are refused, and later reopened on the
+// same address. The connections it accepted are reset when it starts
+// refusing.
+type refusingListener struct {
+	addr net.Addr
+
+	mu      sync.Mutex
+	inner   net.Listener // nil while refusing
+	changed chan struct{}
+	closed  bool
+	conns   map[*trackedConn]struct{}
+}
+
+func newRefusingListener(l net.Listener) *refusingListener {
+	return &refusingListener{
+		addr:    l.Addr(),
+		inner:   l,
+		changed: make(chan struct{}),
+		conns:   map[*trackedConn]struct{}{},
+	}
+}
+
+// trackedConn removes itself from its listener's connections when
+// closed.
+type trackedConn struct {
+	net.Conn
+	l *refusingListener
+}
+
+func (c *trackedConn) Close() error {
+	c.l.mu.Lock()
+	delete(c.l.conns, c)
+	c.l.mu.Unlock()
+	return c.Conn.Close()
+}
+
+func resetConn(conn net.Conn) {
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		_ = tcpConn.SetLinger(0)
+	}
+	conn.Close()
+}
+
+func (l *refusingListener) refuse(refuse bool) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed || refuse == (l.inner == nil) {
+		return nil
+	}
+
+	if refuse {
+		if err := l.inner.Close(); err != nil {
+			return err
+		}
+		l.inner = nil
+		for c := range l.conns {
+			resetConn(c.Conn)
+		}
+		l.conns = map[*trackedConn]struct{}{}
+	} else {
+		inner, err := net.Listen(l.addr.Network(), l.addr.String())
+		if err != nil {
+			return err
+		}
+		l.inner = inner
+	}
+
+	close(l.changed)
+	l.changed = make(chan struct{})
+	return nil
+}
+
+func (l *refusingListener) Accept() (net.Conn, error) {
+	for {
+		l.mu.Lock()
+		inner, changed, closed := l.inner, l.changed, l.closed
+		l.mu.Unlock()
+
+		if closed {
+			return nil, net.ErrClosed
+		}
+		if inner == nil {
+			<-changed
+			continue
+		}
+
+		conn, err := inner.Accept()
+
+		l.mu.Lock()
+		if l.inner != inner || l.closed {
+			// Closed by refuse or Close.
+			l.mu.Unlock()
+			if err == nil {
+				resetConn(conn)
+			}
+			continue
+		}
+		if err != nil {
+			l.mu.Unlock()
+			return nil, err
+		}
+		tc := &trackedConn{Conn: conn, l: l}
+		l.conns[tc] = struct{}{}
+		l.mu.Unlock()
+
+		return tc, nil
+	}
+}
+
+func (l *refusingListener) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	close(l.changed)
+	if l.inner != nil {
+		return l.inner.Close()
+	}
+	return nil
+}
+
+func (l *refusingListener) Addr() net.Addr {
+	return l.addr
+}
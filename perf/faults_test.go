@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestBackendFaults(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	listeners, err := listenReplicas("127.0.0.1", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	faults, listeners := newBackendFaults(listeners)
+
+	backend := Backend{Name: "perf-test-hydra-http-0", TrafficType: HTTPTraffic}
+	for i, listener := range listeners {
+		i, listener := i, listener
+		go serveBackend(ctx, listener, backend, i, faults, nil)
+	}
+
+	client := &http.Client{
+		Timeout: time.Second,
+		Transport: &http.Transport{
+			DisableKeepAlives: true,
+		},
+	}
+	get := func(replica int, path string) (*http.Response, error) {
+		resp, err := client.Get(fmt.Sprintf("http://%s%s", listeners[replica].Addr(), path))
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		_, err = io.ReadAll(resp.Body)
+		return resp, err
+	}
+	set := func(ef EndpointFaults) {
+		t.Helper()
+		if err := faults.set(ef); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectStatus := func(replica int, path string, status int) {
+		t.Helper()
+		resp, err := get(replica, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != status {
+			t.Errorf("replica %d %s: expected %v, got %v", replica, path, status, resp.StatusCode)
+		}
+	}
+
+	expectStatus(0, HealthCheckPath, http.StatusOK)
+
+	set(EndpointFaults{Replicas: []int{0}, Faults: Faults{FailHealthChecks: true}})
+	expectStatus(0, HealthCheckPath, http.StatusServiceUnavailable)
+	expectStatus(0, "/1024.html", http.StatusOK)
+	expectStatus(1, HealthCheckPath, http.StatusOK)
+
+	set(EndpointFaults{Faults: Faults{ErrorPercent: 100}})
+	expectStatus(0, "/1024.html", http.StatusServiceUnavailable)
+	expectStatus(1, "/1024.html", http.StatusServiceUnavailable)
+
+	set(EndpointFaults{Faults: Faults{Latency: specDuration(50 * time.Millisecond)}})
+	start := time.Now()
+	expectStatus(1, "/1024.html", http.StatusOK)
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("expected added latency, responded after %v", elapsed)
+	}
+
+	set(EndpointFaults{Faults: Faults{ResetPercent: 100}})
+	for _, path := range []string{"/1024.html", ResponseSpec{Size: 0}.Path()} {
+		if _, err := get(0, path); err == nil {
+			t.Errorf("%s: expected the connection to be reset", path)
+		}
+	}
+
+	set(EndpointFaults{Faults: Faults{Hang: true}})
+	if _, err := get(0, "/1024.html"); err == nil {
+		t.Error("expected the request to time out")
+	}
+
+	set(EndpointFaults{})
+	established, err := net.Dial("tcp", listeners[1].Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer established.Close()
+	// Wait for the connection to be accepted.
+	if _, err := io.WriteString(established, "GET /healthz HTTP/1.1\r\nHost: test\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := established.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	set(EndpointFaults{Replicas: []int{1}, Faults: Faults{RefuseConnections: true}})
+	if _, err := net.Dial("tcp", listeners[1].Addr().String()); err == nil {
+		t.Error("expected the connection to be refused")
+	}
+	established.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadAll(established); err == nil {
+		t.Error("expected the established connection to be reset")
+	}
+
+	set(EndpointFaults{})
+	expectStatus(0, "/1024.html", http.StatusOK)
+	expectStatus(1, "/1024.html", http.StatusOK)
+
+	for _, ef := range []EndpointFaults{
+		{Replicas: []int{2}},
+		{Faults: Faults{ErrorPercent: 101}},
+	} {
+		if err := faults.set(ef); err == nil {
+			t.Errorf("%+v: expected an error", ef)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path"
+
+	"github.com/yookoala/realpath"
+)
+
+// ProxyConfigGenerator turns a backend topology into the
+// configuration for one proxy.
+type ProxyConfigGenerator interface {
+	// Name is the proxy's name and the subdirectory of the
+	// output directory its configuration is written to.
+	Name() string
+
+	// Generate writes the configuration for topology to
+	// topology.Dir, which is empty.
+	Generate(p *ProgramCtx, topology *ProxyTopology) error
+}
+
+// ProxyTopology is what a ProxyConfigGenerator is given to work
+// from. All paths are absolute.
+type ProxyTopology struct {
+	// Version is the topology version when watching, otherwise
+	// 0.
+	Version uint64
+
+	BackendsByTrafficType BoundBackendsByTrafficType
+	CertPaths             *CertStore
+
+	// OutputDir is the top-level output directory and Dir the
+	// generator's own subdirectory of it.
+	OutputDir string
+	Dir       string
+}
+
+// Route calls route for each backend, in AllTrafficTypes order, with
+// its traffic type's spec. A backend of an unregistered traffic type
+// is an error, so that it cannot be silently left out of a proxy's
+// configuration.
+func (t *ProxyTopology) Route(route func(b BoundBackend, spec *TrafficTypeSpec) error) error {
+	return routeBackends(t.BackendsByTrafficType, route)
+}
+
+func routeBackends(backendsByTrafficType BoundBackendsByTrafficType, route func(b BoundBackend, spec *TrafficTypeSpec) error) error {
+	for trafficType, backends := range backendsByTrafficType {
+		if _, err := lookupTrafficType(trafficType); err != nil && len(backends) > 0 {
+			return err
+		}
+	}
+
+	for _, trafficType := range AllTrafficTypes {
+		for _, b := range backendsByTrafficType[trafficType] {
+			if err := route(b, trafficTypes[trafficType]); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// writeProxyCertificates fetches the current certificates and
+// writes them to OutputDir/certs. It returns the absolute output
+// directory and where the certificates were written.
+func writeProxyCertificates(p *ProgramCtx) (string, *CertStore, error) {
+	certBundle, err := fetchCertficates(p.DiscoveryURL)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if err := os.MkdirAll(p.OutputDir, 0755); err != nil {
+		return "", nil, err
+	}
+
+	// Proxies resolve relative paths from wherever they are
+	// started, or from their own prefix.
+	outputDir, err := realpath.Realpath(p.OutputDir)
+	if err != nil {
+		return "", nil, err
+	}
+
+	certPaths, err := writeCertificates(path.Join(outputDir, "certs"), certBundle)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return outputDir, certPaths, nil
+}
+
+// generateProxyConfig writes g's configuration for
+// backendsByTrafficType, replacing any previous configuration.
+func generateProxyConfig(p *ProgramCtx, g ProxyConfigGenerator, version uint64, backendsByTrafficType BoundBackendsByTrafficType) error {
+	// Certificates are reissued as backends are added, so fetch
+	// them every time.
+	outputDir, certPaths, err := writeProxyCertificates(p)
+	if err != nil {
+		return err
+	}
+
+	topology := &ProxyTopology{
+		Version:               version,
+		BackendsByTrafficType: backendsByTrafficType,
+		CertPaths:             certPaths,
+		OutputDir:             outputDir,
+		Dir:                   path.Join(outputDir, g.Name()),
+	}
+
+	// wipe and recreate all known paths for the proxy's config.
+	if err := os.RemoveAll(topology.Dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(topology.Dir, 0755); err != nil {
+		return err
+	}
+
+	return g.Generate(p, topology)
+}
+
+// runProxyConfigGenerator writes g's configuration for the current
+// topology and, if watch is set, again whenever it changes.
+func runProxyConfigGenerator(p *ProgramCtx, g ProxyConfigGenerator, watch bool) error {
+	if watch {
+		return watchBackendMetadata(p.Context, p.DiscoveryURL, func(version uint64, backendsByTrafficType BoundBackendsByTrafficType) error {
+			if err := generateProxyConfig(p, g, version, backendsByTrafficType); err != nil {
+				return err
+			}
+			log.Printf("generated %s configuration for topology version %v", g.Name(), version)
+			return nil
+		})
+	}
+
+	backendsByTrafficType, err := fetchAllBackendMetadata(p.DiscoveryURL)
+	if err != nil {
+		return err
+	}
+
+	return generateProxyConfig(p, g, 0, backendsByTrafficType)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/alecthomas/kong"
+)
+
+func testTopology() BoundBackendsByTrafficType {
+	backendsByTrafficType := BoundBackendsByTrafficType{}
+	for _, trafficType := range AllTrafficTypes {
+		backendsByTrafficType[trafficType] = []BoundBackend{{
+			Backend: Backend{
+				Name:        "perf-test-hydra-" + string(trafficType) + "-0",
+				TrafficType: trafficType,
+			},
+			Endpoints: []Endpoint{
+				{ListenAddress: "127.0.0.1", Port: 10000},
+				{ListenAddress: "127.0.0.1", Port: 10001},
+			},
+		}}
+	}
+	return backendsByTrafficType
+}
+
+func TestRouteBackends(t *testing.T) {
+	var routed []TrafficType
+	if err := routeBackends(testTopology(), func(b BoundBackend, spec *TrafficTypeSpec) error {
+		if spec.Name != b.TrafficType {
+			t.Errorf("%s: routed with the spec for %s", b.Name, spec.Name)
+		}
+		routed = append(routed, b.TrafficType)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(routed) != len(AllTrafficTypes) {
+		t.Fatalf("expected %d backends to be routed, got %v", len(AllTrafficTypes), routed)
+	}
+	for i, trafficType := range AllTrafficTypes {
+		if routed[i] != trafficType {
+			t.Errorf("expected %v at %d, got %v", trafficType, i, routed[i])
+		}
+	}
+
+	backendsByTrafficType := testTopology()
+	backendsByTrafficType["websocket"] = []BoundBackend{{Backend: Backend{Name: "websocket-0", TrafficType: "websocket"}}}
+	if err := routeBackends(backendsByTrafficType, func(BoundBackend, *TrafficTypeSpec) error {
+		return nil
+	}); err == nil {
+		t.Error("expected an error for an unregistered traffic type")
+	}
+}
+
+func TestProxyConfigGenerators(t *testing.T) {
+	var cli CLI
+	parser, err := kong.New(&cli)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Parsing any command sets every command's flags to their
+	// defaults.
+	if _, err := parser.Parse([]string{"version"}); err != nil {
+		t.Fatal(err)
+	}
+	if cli.GenProxyConfig.Nthreads != 4 {
+		t.Fatalf("expected gen-proxy-config defaults, got %+v", cli.GenProxyConfig)
+	}
+
+	p := &ProgramCtx{Globals: cli.Globals}
+
+	for _, g := range []ProxyConfigGenerator{&cli.GenEnvoyConfig, &cli.GenNginxConfig, &cli.GenProxyConfig} {
+		outputDir := t.TempDir()
+		certPaths := certStore(path.Join(outputDir, "certs"))
+		topology := &ProxyTopology{
+			BackendsByTrafficType: testTopology(),
+			CertPaths:             &certPaths,
+			OutputDir:             outputDir,
+			Dir:                   path.Join(outputDir, g.Name()),
+		}
+		if err := os.MkdirAll(topology.Dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := g.Generate(p, topology); err != nil {
+			t.Errorf("%s: %v", g.Name(), err)
+			continue
+		}
+
+		entries, err := os.ReadDir(topology.Dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) == 0 {
+			t.Errorf("%s: no configuration written", g.Name())
+		}
+
+		if g.Name() == "haproxy" {
+			data, err := os.ReadFile(path.Join(topology.Dir, "haproxy.cfg"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Count(string(data), "server pod:"); got != 2*len(AllTrafficTypes) {
+				t.Errorf("haproxy: expected a server per endpoint, got %d", got)
+			}
+		}
+	}
+}
+
+func TestHAProxyUnknownTemplate(t *testing.T) {
+	dir := t.TempDir()
+	certPaths := certStore(path.Join(dir, "certs"))
+	topology := &ProxyTopology{CertPaths: &certPaths, OutputDir: dir, Dir: dir}
+	backends := []HAProxyBackendConfig{{
+		Name:        "websocket-0",
+		Spec:        &TrafficTypeSpec{Name: "websocket", HAProxyTemplate: "websocket-backend"},
+		TrafficType: "websocket",
+	}}
+	if err := (&GenProxyConfigCmd{}).generateMainConfig(&ProgramCtx{}, topology, backends); err == nil {
+		t.Error("expected an error for an unknown HAProxy template")
+	}
+}
@@ -1,6 +1,6 @@
 module github.com/frobware/haproxy-openshift/perf
 
-go 1.19
+go 1.20
 
 require (
 	github.com/alecthomas/kong v0.7.1
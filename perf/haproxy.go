@@ -7,12 +7,10 @@ import (
 	"html/template"
 	"io"
 	"math/rand"
-	"os"
 	"path"
 )
 
 type HAProxyGlobalConfig struct {
-	Backends                    []HAProxyBackendConfig
 	Certificate                 string
 	EnableHTTP2                 bool
 	EnableLogging               bool
@@ -33,15 +31,22 @@ type HAProxyBackendConfig struct {
 	BackendCookie               string
 	EnableHTTP2                 bool
 	HealthCheckIntervalInMillis int
-	ListenAddress               string
+	HealthCheckPath             string
 	Name                        string
 	OutputDir                   string
-	Port                        string
-	ServerCookie                string
+	Servers                     []HAProxyServerConfig
+	Spec                        *TrafficTypeSpec
 	TLSCACert                   string
 	TrafficType                 TrafficType
 }
 
+// HAProxyServerConfig is a server line, one per endpoint.
+type HAProxyServerConfig struct {
+	Cookie        string
+	ListenAddress string
+	Port          string
+}
+
 const (
 	HTTPBackendMapName      = "os_http_be.map"
 	ReencryptBackendMapName = "os_edge_reencrypt_be.map"
@@ -50,6 +55,49 @@ const (
 	HTTPRedirectMapName     = "os_route_http_redirect.map"
 )
 
+// haproxyMap is a map file that globals.tmpl looks routes up in.
+type haproxyMap struct {
+	Name string
+
+	// Entry is the line added for each route in the map; nil
+	// for maps that are always written empty.
+	Entry func(b HAProxyBackendConfig) string
+}
+
+func haproxyRouteEntry(b HAProxyBackendConfig) string {
+	return fmt.Sprintf("^%s\\.?(:[0-9]+)?(/.*)?$ %s:%s\n", b.Name, b.Spec.HAProxyBackendPrefix, b.Name)
+}
+
+// haproxyMaps are the map files written for every configuration. A
+// traffic type can only be added to one of these.
+var haproxyMaps = []haproxyMap{{
+	Name:  HTTPBackendMapName,
+	Entry: haproxyRouteEntry,
+}, {
+	Name:  ReencryptBackendMapName,
+	Entry: haproxyRouteEntry,
+}, {
+	Name: SNIPassthroughMapName,
+	Entry: func(b HAProxyBackendConfig) string {
+		return fmt.Sprintf("^%s$ 1\n", b.Name)
+	},
+}, {
+	Name:  TCPBackendMapName,
+	Entry: haproxyRouteEntry,
+}, {
+	// no support for redirects; this is deliberate
+	Name: HTTPRedirectMapName,
+}}
+
+func isHAProxyMap(name string) bool {
+	for _, m := range haproxyMaps {
+		if m.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
 //go:embed templates/haproxy/globals.tmpl
 var globalTemplate string
 
@@ -74,87 +122,61 @@ func cookie() string {
 	return string(b)
 }
 
-func filterBackendsByType(types []TrafficType, backends []HAProxyBackendConfig) []HAProxyBackendConfig {
-	var result []HAProxyBackendConfig
-
-	for _, t := range types {
-		for i := range backends {
-			if backends[i].TrafficType == t {
-				result = append(result, backends[i])
-			}
-		}
-	}
-
-	return result
+func (c *GenProxyConfigCmd) Name() string {
+	return "haproxy"
 }
 
 func (c *GenProxyConfigCmd) Run(p *ProgramCtx) error {
-	backendsByTrafficType, err := fetchAllBackendMetadata(p.DiscoveryURL)
-	if err != nil {
-		return err
-	}
-
-	certBundle, err := fetchCertficates(p.DiscoveryURL)
-	if err != nil {
-		return err
-	}
-
-	certPaths, err := writeCertificates(path.Join(p.OutputDir, "certs"), certBundle)
-	if err != nil {
-		return err
-	}
+	return runProxyConfigGenerator(p, c, c.Watch)
+}
 
+func (c *GenProxyConfigCmd) Generate(p *ProgramCtx, topology *ProxyTopology) error {
 	var proxyBackends []HAProxyBackendConfig
 
-	for t, backends := range backendsByTrafficType {
-		for _, b := range backends {
-			proxyBackends = append(proxyBackends, HAProxyBackendConfig{
-				BackendCookie:               cookie(),
-				EnableHTTP2:                 c.EnableHTTP2,
-				HealthCheckIntervalInMillis: c.HealthCheckIntervalInMillis,
-				ListenAddress:               b.ListenAddress,
-				Name:                        b.Name,
-				OutputDir:                   p.OutputDir,
-				Port:                        fmt.Sprintf("%v", b.Port),
-				ServerCookie:                cookie(),
-				TLSCACert:                   certPaths.RootCAFile,
-				TrafficType:                 t,
+	if err := topology.Route(func(b BoundBackend, spec *TrafficTypeSpec) error {
+		var servers []HAProxyServerConfig
+		for _, e := range b.Endpoints {
+			servers = append(servers, HAProxyServerConfig{
+				Cookie:        cookie(),
+				ListenAddress: e.ListenAddress,
+				Port:          fmt.Sprintf("%v", e.Port),
 			})
 		}
+		proxyBackends = append(proxyBackends, HAProxyBackendConfig{
+			BackendCookie:               cookie(),
+			EnableHTTP2:                 c.EnableHTTP2,
+			HealthCheckIntervalInMillis: c.HealthCheckIntervalInMillis,
+			HealthCheckPath:             c.HealthCheckPath,
+			Name:                        b.Name,
+			OutputDir:                   topology.OutputDir,
+			Servers:                     servers,
+			Spec:                        spec,
+			TLSCACert:                   topology.CertPaths.RootCAFile,
+			TrafficType:                 b.TrafficType,
+		})
+		return nil
+	}); err != nil {
+		return err
 	}
 
-	// wipe and recreate all known paths for haproxy config.
-	for _, dirPath := range [][]string{
-		{"haproxy"},
-	} {
-		paths := path.Join(p.OutputDir, path.Join(dirPath...))
-		if err := os.RemoveAll(paths); err != nil {
-			return err
-		}
-		if err := os.MkdirAll(paths, 0755); err != nil {
-			return err
-		}
-	}
-
-	if err := c.generateMainConfig(p, proxyBackends, certPaths.DomainFile); err != nil {
+	if err := c.generateMainConfig(p, topology, proxyBackends); err != nil {
 		return err
 	}
 
-	if err := c.generateMapFiles(p, proxyBackends); err != nil {
+	if err := c.generateMapFiles(topology, proxyBackends); err != nil {
 		return err
 	}
 
-	if err := c.generateCertConfig(p, proxyBackends, certPaths.DomainFile); err != nil {
+	if err := c.generateCertConfig(topology, proxyBackends); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func (c *GenProxyConfigCmd) generateMainConfig(p *ProgramCtx, backends []HAProxyBackendConfig, certFile string) error {
+func (c *GenProxyConfigCmd) generateMainConfig(p *ProgramCtx, topology *ProxyTopology, backends []HAProxyBackendConfig) error {
 	config := HAProxyGlobalConfig{
-		Backends:             backends,
-		Certificate:          certFile,
+		Certificate:          topology.CertPaths.DomainFile,
 		EnableHTTP2:          c.EnableHTTP2,
 		EnableLogging:        c.EnableLogging,
 		HTTPPort:             p.HTTPPort,
@@ -163,7 +185,7 @@ func (c *GenProxyConfigCmd) generateMainConfig(p *ProgramCtx, backends []HAProxy
 		ListenAddress:        c.ListenAddress,
 		Maxconn:              c.Maxconn,
 		Nbthread:             c.Nthreads,
-		OutputDir:            p.OutputDir,
+		OutputDir:            topology.OutputDir,
 		SocketDir:            p.SocketDir,
 		StatsPort:            c.StatsPort,
 		UseUnixDomainSockets: c.UseUnixDomainSockets,
@@ -174,99 +196,49 @@ func (c *GenProxyConfigCmd) generateMainConfig(p *ProgramCtx, backends []HAProxy
 	for _, tmpl := range []*template.Template{
 		template.Must(template.New("globals").Parse(globalTemplate)),
 		template.Must(template.New("defaults").Parse(defaultTemplate)),
-		template.Must(template.New("backends").Parse(backendTemplate)),
 	} {
 		if err := tmpl.Execute(&haproxyConf, config); err != nil {
 			return err
 		}
 	}
 
-	if err := createFile(path.Join(p.OutputDir, "haproxy", "haproxy.cfg"), haproxyConf.Bytes()); err != nil {
+	// Each backend is defined by the fragment its traffic type
+	// names.
+	backendTmpl := template.Must(template.New("backends").Parse(backendTemplate))
+	for _, b := range backends {
+		if backendTmpl.Lookup(b.Spec.HAProxyTemplate) == nil {
+			return fmt.Errorf("%s: unknown HAProxy template %q", b.TrafficType, b.Spec.HAProxyTemplate)
+		}
+		if err := backendTmpl.ExecuteTemplate(&haproxyConf, b.Spec.HAProxyTemplate, b); err != nil {
+			return err
+		}
+	}
+
+	if err := createFile(path.Join(topology.Dir, "haproxy.cfg"), haproxyConf.Bytes()); err != nil {
 		return err
 	}
 
-	if err := createFile(path.Join(p.OutputDir, "haproxy", "error-page-404.http"), bytes.NewBuffer([]byte(error404)).Bytes()); err != nil {
+	if err := createFile(path.Join(topology.Dir, "error-page-404.http"), bytes.NewBuffer([]byte(error404)).Bytes()); err != nil {
 		return err
 	}
 
-	return createFile(path.Join(p.OutputDir, "haproxy", "error-page-503.http"), bytes.NewBuffer([]byte(error503)).Bytes())
+	return createFile(path.Join(topology.Dir, "error-page-503.http"), bytes.NewBuffer([]byte(error503)).Bytes())
 }
 
-func (c *GenProxyConfigCmd) generateMapFiles(p *ProgramCtx, backends []HAProxyBackendConfig) error {
-	type MapEntryFunc func(backend HAProxyBackendConfig) string
-
-	backendMaps := []struct {
-		MapName      string
-		TrafficTypes []TrafficType
-		MapEntry     MapEntryFunc
-		Buffer       *bytes.Buffer
-	}{{
-		MapName:      HTTPBackendMapName,
-		TrafficTypes: []TrafficType{HTTPTraffic},
-		Buffer:       &bytes.Buffer{},
-		MapEntry: func(b HAProxyBackendConfig) string {
-			switch b.TrafficType {
-			case HTTPTraffic:
-				return fmt.Sprintf("^%s\\.?(:[0-9]+)?(/.*)?$ be_http:%s\n", b.Name, b.Name)
-			default:
-				panic("unexpected traffic type: " + b.TrafficType)
-			}
-		},
-	}, {
-		MapName:      ReencryptBackendMapName,
-		TrafficTypes: []TrafficType{ReencryptTraffic, EdgeTraffic},
-		Buffer:       &bytes.Buffer{},
-		MapEntry: func(b HAProxyBackendConfig) string {
-			switch b.TrafficType {
-			case EdgeTraffic:
-				return fmt.Sprintf("^%s\\.?(:[0-9]+)?(/.*)?$ be_edge_http:%s\n", b.Name, b.Name)
-			case ReencryptTraffic:
-				return fmt.Sprintf("^%s\\.?(:[0-9]+)?(/.*)?$ be_secure:%s\n", b.Name, b.Name)
-			default:
-				panic("unexpected traffic type: " + b.TrafficType)
-			}
-		},
-	}, {
-		MapName:      SNIPassthroughMapName,
-		TrafficTypes: []TrafficType{PassthroughTraffic},
-		Buffer:       &bytes.Buffer{},
-		MapEntry: func(b HAProxyBackendConfig) string {
-			switch b.TrafficType {
-			case PassthroughTraffic:
-				return fmt.Sprintf("^%s$ 1\n", b.Name)
-			default:
-				panic("unexpected traffic type: " + b.TrafficType)
-			}
-		},
-	}, {
-		MapName:      TCPBackendMapName,
-		TrafficTypes: []TrafficType{PassthroughTraffic},
-		Buffer:       &bytes.Buffer{},
-		MapEntry: func(b HAProxyBackendConfig) string {
-			switch b.TrafficType {
-			case PassthroughTraffic:
-				return fmt.Sprintf("^%s\\.?(:[0-9]+)?(/.*)?$ be_tcp:%s\n", b.Name, b.Name)
-			default:
-				panic("unexpected traffic type: " + b.TrafficType)
-			}
-		},
-	}, {
-		MapName:      HTTPRedirectMapName,
-		TrafficTypes: []TrafficType{},
-		Buffer:       &bytes.Buffer{},
-		MapEntry: func(b HAProxyBackendConfig) string {
-			// no support for redirects; this is deliberate
-			return ""
-		},
-	}}
-
-	for _, m := range backendMaps {
-		for _, b := range filterBackendsByType(m.TrafficTypes, backends) {
-			if _, err := io.WriteString(m.Buffer, m.MapEntry(b)); err != nil {
-				return err
+func (c *GenProxyConfigCmd) generateMapFiles(topology *ProxyTopology, backends []HAProxyBackendConfig) error {
+	for _, m := range haproxyMaps {
+		var buffer bytes.Buffer
+		for _, b := range backends {
+			for _, mapName := range b.Spec.HAProxyMaps {
+				if mapName != m.Name || m.Entry == nil {
+					continue
+				}
+				if _, err := io.WriteString(&buffer, m.Entry(b)); err != nil {
+					return err
+				}
 			}
 		}
-		if err := createFile(path.Join(p.OutputDir, "haproxy", m.MapName), m.Buffer.Bytes()); err != nil {
+		if err := createFile(path.Join(topology.Dir, m.Name), buffer.Bytes()); err != nil {
 			return err
 		}
 	}
@@ -274,10 +246,15 @@ func (c *GenProxyConfigCmd) generateMapFiles(p *ProgramCtx, backends []HAProxyBa
 	return nil
 }
 
-func (c *GenProxyConfigCmd) generateCertConfig(p *ProgramCtx, backends []HAProxyBackendConfig, certFile string) error {
+func (c *GenProxyConfigCmd) generateCertConfig(topology *ProxyTopology, backends []HAProxyBackendConfig) error {
+	certFile := topology.CertPaths.DomainFile
+
 	var certConfigMap bytes.Buffer
 
-	for _, b := range filterBackendsByType([]TrafficType{EdgeTraffic, ReencryptTraffic}, backends) {
+	for _, b := range backends {
+		if b.Spec.PortRole != HTTPSPortRole {
+			continue
+		}
 		var entry string
 		if b.EnableHTTP2 {
 			entry = fmt.Sprintf("%s [alpn h2,http1.1] %s\n", certFile, b.Name)
@@ -289,5 +266,5 @@ func (c *GenProxyConfigCmd) generateCertConfig(p *ProgramCtx, backends []HAProxy
 		}
 	}
 
-	return createFile(path.Join(p.OutputDir, "haproxy", "cert_config.map"), certConfigMap.Bytes())
+	return createFile(path.Join(topology.Dir, "cert_config.map"), certConfigMap.Bytes())
 }
@@ -0,0 +1,162 @@
+// Package histogram implements a log-linear latency histogram in the
+// style of HdrHistogram.
+//
+// Values below subBucketCount are recorded exactly. Larger values
+// are recorded in power-of-two buckets, each split into
+// subBucketCount/2 linear sub-buckets, which bounds the relative
+// error of any reported value to 1/(subBucketCount/2). Buckets are
+// allocated on demand so a histogram costs little until it records
+// large values.
+package histogram
+
+import (
+	"math"
+	"math/bits"
+	"time"
+)
+
+const (
+	subBucketBits      = 8
+	subBucketCount     = 1 << subBucketBits
+	subBucketHalfCount = subBucketCount / 2
+)
+
+// Histogram records non-negative int64 values. The zero value is
+// ready to use. A Histogram is not safe for concurrent use.
+type Histogram struct {
+	counts     []int64
+	totalCount int64
+	min        int64
+	max        int64
+	sum        float64
+}
+
+// New returns an empty histogram.
+func New() *Histogram {
+	return &Histogram{}
+}
+
+func countsIndex(v int64) int {
+	if v < subBucketCount {
+		return int(v)
+	}
+	shift := bits.Len64(uint64(v)) - subBucketBits
+	return subBucketCount + (shift-1)*subBucketHalfCount + int(v>>shift) - subBucketHalfCount
+}
+
+// highestEquivalentValue returns the largest value that is recorded
+// in the same slot as index.
+func highestEquivalentValue(index int) int64 {
+	if index < subBucketCount {
+		return int64(index)
+	}
+	shift := (index-subBucketCount)/subBucketHalfCount + 1
+	sub := int64((index-subBucketCount)%subBucketHalfCount + subBucketHalfCount)
+	return (sub+1)<<shift - 1
+}
+
+// Record adds v to the histogram. Negative values are recorded as
+// zero.
+func (h *Histogram) Record(v int64) {
+	if v < 0 {
+		v = 0
+	}
+	i := countsIndex(v)
+	if i >= len(h.counts) {
+		counts := make([]int64, i+1, 2*(i+1))
+		copy(counts, h.counts)
+		h.counts = counts
+	}
+	h.counts[i] += 1
+	if h.totalCount == 0 || v < h.min {
+		h.min = v
+	}
+	if v > h.max {
+		h.max = v
+	}
+	h.totalCount += 1
+	h.sum += float64(v)
+}
+
+// RecordDuration records d in microseconds.
+func (h *Histogram) RecordDuration(d time.Duration) {
+	h.Record(d.Microseconds())
+}
+
+// Merge adds all values recorded in other to h.
+func (h *Histogram) Merge(other *Histogram) {
+	if other.totalCount == 0 {
+		return
+	}
+	if len(other.counts) > len(h.counts) {
+		counts := make([]int64, len(other.counts))
+		copy(counts, h.counts)
+		h.counts = counts
+	}
+	for i, n := range other.counts {
+		h.counts[i] += n
+	}
+	if h.totalCount == 0 || other.min < h.min {
+		h.min = other.min
+	}
+	if other.max > h.max {
+		h.max = other.max
+	}
+	h.totalCount += other.totalCount
+	h.sum += other.sum
+}
+
+// TotalCount returns the number of recorded values.
+func (h *Histogram) TotalCount() int64 {
+	return h.totalCount
+}
+
+// Min returns the smallest recorded value.
+func (h *Histogram) Min() int64 {
+	return h.min
+}
+
+// Max returns the largest recorded value.
+func (h *Histogram) Max() int64 {
+	return h.max
+}
+
+// Mean returns the arithmetic mean of the recorded values.
+func (h *Histogram) Mean() float64 {
+	if h.totalCount == 0 {
+		return 0
+	}
+	return h.sum / float64(h.totalCount)
+}
+
+// ValueAtPercentile returns the value below which percentile percent
+// of the recorded values fall. The result is never larger than Max.
+func (h *Histogram) ValueAtPercentile(percentile float64) int64 {
+	if h.totalCount == 0 {
+		return 0
+	}
+	if percentile > 100 {
+		percentile = 100
+	}
+	target := int64(math.Ceil(percentile / 100 * float64(h.totalCount)))
+	if target < 1 {
+		target = 1
+	}
+	var seen int64
+	for i, n := range h.counts {
+		seen += n
+		if seen >= target {
+			if v := highestEquivalentValue(i); v < h.max {
+				return v
+			}
+			return h.max
+		}
+	}
+	return h.max
+}
+
+// DurationAtPercentile is ValueAtPercentile for histograms populated
+// by RecordDuration.
+func (h *Histogram) DurationAtPercentile(percentile float64) time.Duration {
+	return time.Duration(h.ValueAtPercentile(percentile)) * time.Microsecond
+}
@@ -0,0 +1,70 @@
+package histogram
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestIndexRoundTrip(t *testing.T) {
+	for _, v := range []int64{0, 1, 255, 256, 257, 511, 512, 1000, 123456, 1 << 40} {
+		i := countsIndex(v)
+		if hev := highestEquivalentValue(i); hev < v {
+			t.Errorf("value %d: highest equivalent value %d is smaller", v, hev)
+		}
+		if i > 0 && highestEquivalentValue(i-1) >= v {
+			t.Errorf("value %d: previous slot %d already covers it", v, i-1)
+		}
+	}
+}
+
+func TestPercentiles(t *testing.T) {
+	h := New()
+	var values []int64
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 100000; i++ {
+		v := r.Int63n(1000000)
+		values = append(values, v)
+		h.Record(v)
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+
+	if h.TotalCount() != int64(len(values)) {
+		t.Fatalf("expected %d values, got %d", len(values), h.TotalCount())
+	}
+	if h.Min() != values[0] || h.Max() != values[len(values)-1] {
+		t.Fatalf("expected min/max %d/%d, got %d/%d", values[0], values[len(values)-1], h.Min(), h.Max())
+	}
+
+	for _, p := range []float64{50, 90, 99, 99.9} {
+		exact := values[int(p/100*float64(len(values)))-1]
+		got := h.ValueAtPercentile(p)
+		if got < exact || float64(got-exact) > float64(exact)/subBucketHalfCount+1 {
+			t.Errorf("p%v: expected ~%d, got %d", p, exact, got)
+		}
+	}
+
+	if got := h.ValueAtPercentile(100); got != h.Max() {
+		t.Errorf("p100: expected %d, got %d", h.Max(), got)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	a, b := New(), New()
+	a.RecordDuration(time.Millisecond)
+	b.RecordDuration(3 * time.Millisecond)
+	b.RecordDuration(5 * time.Second)
+
+	a.Merge(b)
+
+	if a.TotalCount() != 3 {
+		t.Fatalf("expected 3 values, got %d", a.TotalCount())
+	}
+	if a.Min() != 1000 || a.Max() != 5000000 {
+		t.Fatalf("unexpected min/max %d/%d", a.Min(), a.Max())
+	}
+	if got := a.DurationAtPercentile(50); got < 3*time.Millisecond || got > 3*time.Millisecond+20*time.Microsecond {
+		t.Fatalf("unexpected median %v", got)
+	}
+}
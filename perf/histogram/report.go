@@ -0,0 +1,113 @@
+package histogram
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// ReportedPercentiles are the percentiles a Report writes.
+var ReportedPercentiles = []float64{50, 90, 99, 99.9}
+
+// Report accumulates request latencies overall, per group (for
+// example, traffic type) and per host.
+type Report struct {
+	groups  []string
+	groupOf func(host string) (string, bool)
+
+	overall *Histogram
+	byGroup map[string]*Histogram
+	byHost  map[string]*Histogram
+}
+
+// NewReport returns an empty report. groupOf assigns a host to a
+// group, if any. Groups are written in the order of groups, and any
+// others after them in sorted order.
+func NewReport(groups []string, groupOf func(host string) (string, bool)) *Report {
+	return &Report{
+		groups:  groups,
+		groupOf: groupOf,
+		overall: New(),
+		byGroup: map[string]*Histogram{},
+		byHost:  map[string]*Histogram{},
+	}
+}
+
+// Record records a request to host that took latency.
+func (r *Report) Record(host string, latency time.Duration) {
+	r.overall.RecordDuration(latency)
+
+	if g, ok := r.groupOf(host); ok {
+		if _, ok := r.byGroup[g]; !ok {
+			r.byGroup[g] = New()
+		}
+		r.byGroup[g].RecordDuration(latency)
+	}
+
+	if _, ok := r.byHost[host]; !ok {
+		r.byHost[host] = New()
+	}
+	r.byHost[host].RecordDuration(latency)
+}
+
+func formatLatency(d time.Duration) string {
+	return fmt.Sprintf("%.3f", float64(d)/float64(time.Millisecond))
+}
+
+func writeRow(w io.Writer, name string, h *Histogram) error {
+	row := fmt.Sprintf("%s\t%d", name, h.TotalCount())
+	for _, p := range ReportedPercentiles {
+		row += "\t" + formatLatency(h.DurationAtPercentile(p))
+	}
+	row += "\t" + formatLatency(time.Duration(h.Max())*time.Microsecond)
+	_, err := fmt.Fprintln(w, row)
+	return err
+}
+
+func sortedKeys(m map[string]*Histogram) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Write prints the percentiles, in milliseconds, as a table: all
+// requests, then each group, then each host.
+func (r *Report) Write(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+
+	header := "latency (ms)\tcount"
+	for _, p := range ReportedPercentiles {
+		header += fmt.Sprintf("\tp%v", p)
+	}
+	header += "\tmax"
+	if _, err := fmt.Fprintln(tw, header); err != nil {
+		return err
+	}
+
+	if err := writeRow(tw, "all", r.overall); err != nil {
+		return err
+	}
+
+	written := map[string]bool{}
+	for _, g := range append(append([]string{}, r.groups...), sortedKeys(r.byGroup)...) {
+		if h, ok := r.byGroup[g]; ok && !written[g] {
+			written[g] = true
+			if err := writeRow(tw, g, h); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, host := range sortedKeys(r.byHost) {
+		if err := writeRow(tw, host, r.byHost[host]); err != nil {
+			return err
+		}
+	}
+
+	return tw.Flush()
+}
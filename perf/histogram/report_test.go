@@ -0,0 +1,44 @@
+package histogram
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReport(t *testing.T) {
+	r := NewReport([]string{"http", "edge"}, func(host string) (string, bool) {
+		group, _, ok := strings.Cut(host, "-")
+		return group, ok
+	})
+
+	for host, latency := range map[string]time.Duration{
+		"edge-0":   2 * time.Millisecond,
+		"http-0":   time.Millisecond,
+		"tcp-0":    3 * time.Millisecond,
+		"example":  4 * time.Millisecond,
+		"http-1":   time.Millisecond,
+		"reenc-0":  5 * time.Millisecond,
+		"reenc-1":  5 * time.Millisecond,
+		"passth-0": 6 * time.Millisecond,
+	} {
+		r.Record(host, latency)
+	}
+
+	var out strings.Builder
+	if err := r.Write(&out); err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n")[1:] {
+		fields := strings.Fields(line)
+		names = append(names, fields[0]+"="+fields[1])
+	}
+
+	// Known groups first, in order, then any others sorted.
+	expected := "all=8 http=2 edge=1 passth=1 reenc=2 tcp=1 edge-0=1 example=1 http-0=1 http-1=1 passth-0=1 reenc-0=1 reenc-1=1 tcp-0=1"
+	if got := strings.Join(names, " "); got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
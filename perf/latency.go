@@ -0,0 +1,16 @@
+package main
+
+import "github.com/frobware/haproxy-openshift/perf/histogram"
+
+// newLatencyReport returns a report that accumulates request
+// latencies overall, per traffic type and per host.
+func newLatencyReport() *histogram.Report {
+	groups := make([]string, 0, len(AllTrafficTypes))
+	for _, t := range AllTrafficTypes {
+		groups = append(groups, string(t))
+	}
+	return histogram.NewReport(groups, func(host string) (string, bool) {
+		t, ok := trafficTypeFromHostname(host)
+		return string(t), ok
+	})
+}
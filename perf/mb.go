@@ -1,25 +1,52 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math/rand"
 	"net"
 	"net/http"
 	"os"
+	"sort"
+	"strings"
 	"time"
 )
 
+// lateSendThreshold is how far behind its intended send time a
+// request may start before an open-loop test counts it as late.
+const lateSendThreshold = time.Millisecond
+
 type fetchResult struct {
-	req  *http.Request
-	resp *http.Response
-	err  error
+	req       *http.Request
+	host      string
+	status    int
+	expected  int
+	latency   time.Duration
+	sendDelay time.Duration
+	err       error
+
+	// endpoint is the backend endpoint that served the request,
+	// if it said.
+	endpoint string
+
+	// pinned is set on the first response of a sticky session and
+	// moved on any later response served by a different endpoint.
+	pinned bool
+	moved  bool
 }
 
-func newHTTPClient() *http.Client {
+func newHTTPClient(tlsSessionReuse bool) *http.Client {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: true,
+	}
+	if tlsSessionReuse {
+		tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+	}
 	return &http.Client{
 		Transport: &http.Transport{
 			DialContext: (&net.Dialer{
@@ -32,113 +59,374 @@ func newHTTPClient() *http.Client {
 			MaxIdleConnsPerHost:   0, // no limit
 			MaxConnsPerHost:       0, // no limit
 			DisableKeepAlives:     false,
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: true,
-			},
+			TLSClientConfig:       tlsConfig,
 		},
 	}
 }
 
-func (c *TestCmd) Run(p *ProgramCtx) error {
-	data, err := os.ReadFile(c.RequestFile)
-	if err != nil {
-		return err
+// mbClient replays a single MBRequest over its own connection, much
+// like a client in https://github.com/jmencak/mb. When
+// KeepAliveRequests is non-zero the connection is closed after that
+// many requests and a new one is opened; zero means the connection
+// is kept alive for the duration of the test.
+//
+// A sticky client replays the cookies it is set and expects every
+// response to come from the endpoint that served the first.
+type mbClient struct {
+	client            *http.Client
+	host              string
+	keepAliveRequests int
+	request           *http.Request
+	closingRequest    *http.Request
+	expectedStatus    int
+
+	sticky   bool
+	cookies  map[string]string
+	endpoint string
+}
+
+func newMBClient(ctx context.Context, r MBRequest, defaultPort func(scheme string) int, sticky bool) (*mbClient, error) {
+	method := r.Method
+	if method == "" {
+		method = http.MethodGet
 	}
 
-	var requests []MBRequest
-	if err := json.Unmarshal(data, &requests); err != nil {
-		return err
+	port := r.Port
+	if port == 0 {
+		port = defaultPort(r.Scheme)
 	}
-	if len(requests) == 0 {
-		return nil
+
+	url := fmt.Sprintf("%v://%v:%v%v", r.Scheme, r.Host, port, r.Path)
+
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return nil, err
 	}
 
-	resultCh := make(chan *fetchResult)
-	requestCh := make(chan *http.Request)
+	closingRequest := req.Clone(ctx)
+	closingRequest.Close = true
+
+	return &mbClient{
+		client:            newHTTPClient(r.TLSSessionReuse),
+		host:              r.Host,
+		keepAliveRequests: r.KeepAliveRequests,
+		request:           req,
+		closingRequest:    closingRequest,
+		expectedStatus:    expectedStatus(r.Path),
+		sticky:            sticky,
+		cookies:           map[string]string{},
+	}, nil
+}
 
-	fetch := func(req *http.Request, client *http.Client) *fetchResult {
-		result := &fetchResult{req: req}
-		result.resp, result.err = client.Do(req)
+// setCookies sets req's Cookie header from the cookies the client
+// has been set. The header is managed by hand rather than with a
+// cookie jar as the proxy marks its cookies secure, and a jar would
+// not send them over plain HTTP.
+func (c *mbClient) setCookies(req *http.Request) {
+	if len(c.cookies) == 0 {
+		return
+	}
+	var pairs []string
+	for name, value := range c.cookies {
+		pairs = append(pairs, (&http.Cookie{Name: name, Value: value}).String())
+	}
+	sort.Strings(pairs)
+	req.Header.Set("Cookie", strings.Join(pairs, "; "))
+}
+
+// fetch issues req and reads the response. The latency is measured
+// from intended, the time the request should have been sent, to the
+// end of the body.
+func (c *mbClient) fetch(req *http.Request, intended time.Time) *fetchResult {
+	result := &fetchResult{req: req, host: c.host, expected: c.expectedStatus}
+	if c.sticky {
+		c.setCookies(req)
+	}
+	result.sendDelay = time.Since(intended)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		result.err = err
 		return result
 	}
+	_, result.err = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	result.latency = time.Since(intended)
+	result.status = resp.StatusCode
+	result.endpoint = resp.Header.Get(BackendEndpointHeader)
 
-	fetcher := func(client *http.Client) {
-		for {
-			request := <-requestCh
-			resultCh <- fetch(request, client)
+	if c.sticky {
+		for _, cookie := range resp.Cookies() {
+			c.cookies[cookie.Name] = cookie.Value
+		}
+		switch {
+		case result.endpoint == "":
+		case c.endpoint == "":
+			c.endpoint = result.endpoint
+			result.pinned = true
+		case result.endpoint != c.endpoint:
+			result.moved = true
 		}
 	}
 
-	port := func(scheme string) int {
-		switch scheme {
-		case "http":
-			return p.HTTPPort
-		default:
-			return p.HTTPSPort
+	return result
+}
+
+// run issues requests until ctx is done, sending each result to
+// resultCh. If schedule is nil requests are sent back-to-back
+// (closed loop); otherwise each request is sent at the next intended
+// time read from schedule (open loop).
+func (c *mbClient) run(ctx context.Context, resultCh chan<- *fetchResult, schedule <-chan time.Time) {
+	requestsOnConnection := 0
+
+	for {
+		intended := time.Now()
+		if schedule != nil {
+			select {
+			case intended = <-schedule:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		req := c.request
+		requestsOnConnection += 1
+		if c.keepAliveRequests > 0 && requestsOnConnection >= c.keepAliveRequests {
+			req = c.closingRequest
+			requestsOnConnection = 0
+		}
+
+		result := c.fetch(req, intended)
+		if result.err != nil {
+			// The transport discards a connection
+			// that failed; the next request will
+			// be on a new one.
+			requestsOnConnection = 0
+		}
+
+		select {
+		case resultCh <- result:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// scheduleArrivals sends the intended send time of each request to
+// schedule at rate requests per second until ctx is done. Intended
+// times are derived from the schedule, never from when a previous
+// send completed, so a slow proxy cannot hold back the offered load.
+func scheduleArrivals(ctx context.Context, schedule chan<- time.Time, rate float64, poisson bool) {
+	interval := func() time.Duration {
+		if poisson {
+			return time.Duration(rand.ExpFloat64() / rate * float64(time.Second))
+		}
+		return time.Duration(float64(time.Second) / rate)
+	}
+
+	next := time.Now()
+
+	for {
+		if d := time.Until(next); d > 0 {
+			select {
+			case <-time.After(d):
+			case <-ctx.Done():
+				return
+			}
+		}
+		select {
+		case schedule <- next:
+		case <-ctx.Done():
+			return
 		}
+		next = next.Add(interval())
 	}
+}
 
-	pendingRequests := []*http.Request{}
+// arrivalRates returns the share of rate each of requests is sent
+// at, in proportion to its clients.
+func arrivalRates(requests []MBRequest, rate float64) []float64 {
+	totalClients := 0
+	for _, r := range requests {
+		totalClients += r.Clients
+	}
 
-	for i := 0; i < requests[0].Clients; i++ {
-		go fetcher(newHTTPClient())
-		for j := range requests {
-			url := fmt.Sprintf("%v://%v:%v%v",
-				requests[j].Scheme,
-				requests[j].Host,
-				port(requests[j].Scheme),
-				requests[j].Path)
-			req, err := http.NewRequest("GET", url, nil)
+	rates := make([]float64, len(requests))
+	for i, r := range requests {
+		if totalClients > 0 {
+			rates[i] = rate * float64(r.Clients) / float64(totalClients)
+		}
+	}
+	return rates
+}
+
+// startMBClients starts r.Clients clients for each of requests, which
+// send their results to resultCh until ctx is done. If rate is
+// positive the clients of each request share a schedule, at that
+// request's share of rate by clients, so that the clients of a fast
+// route cannot take the sends meant for a slow one.
+func startMBClients(ctx context.Context, requests []MBRequest, defaultPort func(scheme string) int, sticky bool, rate float64, poisson bool, resultCh chan<- *fetchResult) error {
+	clients := make([][]*mbClient, len(requests))
+
+	for i, r := range requests {
+		for j := 0; j < r.Clients; j++ {
+			client, err := newMBClient(ctx, r, defaultPort, sticky)
 			if err != nil {
 				return err
 			}
-			pendingRequests = append(pendingRequests, req)
+			clients[i] = append(clients[i], client)
+		}
+	}
+
+	rates := arrivalRates(requests, rate)
+
+	for i, r := range requests {
+		var schedule chan time.Time
+		if rate > 0 && r.Clients > 0 {
+			schedule = make(chan time.Time, r.Clients)
+			go scheduleArrivals(ctx, schedule, rates[i], poisson)
 		}
+		for _, client := range clients[i] {
+			go client.run(ctx, resultCh, schedule)
+		}
+	}
+
+	return nil
+}
+
+func readMBRequests(filename string) ([]MBRequest, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var requests []MBRequest
+	if err := json.Unmarshal(data, &requests); err != nil {
+		return nil, err
+	}
+
+	return requests, nil
+}
+
+// defaultPort is the proxy port requests of scheme are sent to when
+// they do not specify one.
+func (g Globals) defaultPort(scheme string) int {
+	switch scheme {
+	case "http":
+		return g.HTTPPort
+	default:
+		return g.HTTPSPort
+	}
+}
+
+func (c *TestCmd) Run(p *ProgramCtx) error {
+	return c.run(p, os.Stdout)
+}
+
+// run executes the test and writes the summary and latency report
+// to out.
+func (c *TestCmd) run(p *ProgramCtx, out io.Writer) error {
+	requests, err := readMBRequests(c.RequestFile)
+	if err != nil {
+		return err
+	}
+	if len(requests) == 0 {
+		return nil
+	}
+
+	// The topology gives the balance report the endpoints that
+	// serve no requests.
+	backendsByTrafficType, err := fetchAllBackendMetadata(p.DiscoveryURL)
+	if err != nil {
+		log.Printf("only endpoints that serve requests are reported: %v", err)
 	}
 
+	ctx, cancel := context.WithCancel(p.Context)
+	defer cancel()
+
+	resultCh := make(chan *fetchResult)
+
+	if err := startMBClients(ctx, requests, p.defaultPort, c.Sticky, c.Rate, c.Arrival == "poisson", resultCh); err != nil {
+		return err
+	}
+
+	latencies := newLatencyReport()
+	balance := newBalanceReport(backendsByTrafficType)
+	sessions := 0
+	sessionsMoved := 0
 	fetchErrors := 0
 	fetchBadStatus := 0
 	hits := 0
+	lateSends := 0
+	var maxSendDelay time.Duration
 	progressTicker := time.Tick(1 * time.Second)
 	testComplete := time.After(c.Duration)
 
 	for {
-		var sendCh chan<- *http.Request
-		var link *http.Request
-
-		if len(pendingRequests) > 0 {
-			sendCh = requestCh
-			link = pendingRequests[0]
-		}
-
 		select {
 		case <-p.Context.Done():
 			return errors.New("test interrupted")
 
 		case <-testComplete:
-			log.Printf("hits: %v errors: %v bad_status: %v request/s: %.0f", hits, fetchErrors, fetchBadStatus, float64(hits)/float64(c.Duration.Seconds()))
+			if _, err := fmt.Fprintf(out, "hits: %v errors: %v bad_status: %v request/s: %.2f\n", hits, fetchErrors, fetchBadStatus, float64(hits)/float64(c.Duration.Seconds())); err != nil {
+				return err
+			}
+			if c.Rate > 0 && hits > 0 {
+				if _, err := fmt.Fprintf(out, "target request/s: %.0f late_sends: %v (%.2f%%) max_send_delay: %v\n", c.Rate, lateSends, 100*float64(lateSends)/float64(hits), maxSendDelay); err != nil {
+					return err
+				}
+			}
+			if c.Sticky {
+				if _, err := fmt.Fprintf(out, "sticky sessions: %v moved: %v\n", sessions, sessionsMoved); err != nil {
+					return err
+				}
+			}
+			if err := latencies.Write(out); err != nil {
+				return err
+			}
+			if len(balance.byHost) > 0 {
+				if _, err := fmt.Fprintln(out); err != nil {
+					return err
+				}
+				if err := balance.write(out); err != nil {
+					return err
+				}
+			}
+			if sessionsMoved > 0 {
+				return fmt.Errorf("%v requests were routed away from their session's endpoint", sessionsMoved)
+			}
 			return nil
 
 		case <-progressTicker:
 			log.Printf("hits: %v errors: %v", hits, fetchErrors)
 
-		case sendCh <- link:
-			pendingRequests = pendingRequests[1:]
-
 		case result := <-resultCh:
-			pendingRequests = append(pendingRequests, result.req)
 			hits += 1 // should we record a hit if there was an error?
+			if c.Rate > 0 {
+				if result.sendDelay > lateSendThreshold {
+					lateSends += 1
+				}
+				if result.sendDelay > maxSendDelay {
+					maxSendDelay = result.sendDelay
+				}
+			}
 			if result.err != nil {
 				fetchErrors += 1
 				log.Printf("%s %q failed: %v", result.req.Method, result.req.URL, result.err)
 				continue
 			}
-			if result.resp.StatusCode != http.StatusOK {
+			latencies.Record(result.host, result.latency)
+			balance.record(result.host, result.endpoint)
+			if result.pinned {
+				sessions += 1
+			}
+			if result.moved {
+				sessionsMoved += 1
+				log.Printf("%s %q served by %s, expected the session's endpoint", result.req.Method, result.req.URL, result.endpoint)
+			}
+			if result.status != result.expected {
 				fetchBadStatus += 1
-				log.Printf("%s %q bad_status: %v", result.req.Method, result.req.URL, result.resp.StatusCode)
+				log.Printf("%s %q bad_status: %v", result.req.Method, result.req.URL, result.status)
 			}
-			io.Copy(io.Discard, result.resp.Body)
-			result.resp.Body.Close()
 		}
 	}
 }
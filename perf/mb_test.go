@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestArrivalRates(t *testing.T) {
+	// A request with three times the clients is sent three times
+	// the requests, however quickly its route responds.
+	requests := []MBRequest{{Clients: 1}, {Clients: 3}, {Clients: 0}}
+	rates := arrivalRates(requests, 200)
+	for i, expected := range []float64{50, 150, 0} {
+		if rates[i] != expected {
+			t.Errorf("request %d: expected %v requests/s, got %v", i, expected, rates[i])
+		}
+	}
+}
+
+// intendedTimes returns the first n intended send times scheduled at
+// rate.
+func intendedTimes(t *testing.T, n int, rate float64, poisson bool) []time.Time {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	schedule := make(chan time.Time)
+	go scheduleArrivals(ctx, schedule, rate, poisson)
+
+	times := make([]time.Time, n)
+	for i := range times {
+		times[i] = <-schedule
+	}
+	return times
+}
+
+func TestScheduleArrivalsConstant(t *testing.T) {
+	times := intendedTimes(t, 100, 10000, false)
+	for i := 1; i < len(times); i++ {
+		if d := times[i].Sub(times[i-1]); d != 100*time.Microsecond {
+			t.Fatalf("send %d: expected 100µs after the previous, got %v", i, d)
+		}
+	}
+}
+
+func TestScheduleArrivalsPoisson(t *testing.T) {
+	const n = 2000
+	times := intendedTimes(t, n, 100000, true)
+
+	distinct := map[time.Duration]bool{}
+	for i := 1; i < len(times); i++ {
+		d := times[i].Sub(times[i-1])
+		if d < 0 {
+			t.Fatalf("send %d: scheduled before the previous", i)
+		}
+		distinct[d] = true
+	}
+	if len(distinct) < n/2 {
+		t.Errorf("expected random intervals, got %d distinct", len(distinct))
+	}
+
+	// The mean interval of an exponential distribution is 1/rate;
+	// over 2000 intervals it is within 10% but for one run in
+	// ~10^5.
+	mean := times[n-1].Sub(times[0]) / (n - 1)
+	if mean < 9*time.Microsecond || mean > 11*time.Microsecond {
+		t.Errorf("expected a mean interval of about 10µs, got %v", mean)
+	}
+}
@@ -1,10 +1,15 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
+	"time"
 )
 
 func fetchAllBackendMetadata(uri string) (BoundBackendsByTrafficType, error) {
@@ -48,3 +53,143 @@ func fetchCertficates(uri string) (*Certificates, error) {
 	}
 	return nil, fmt.Errorf("/certs request failed %v", resp.StatusCode)
 }
+
+// postJSON posts v to url and fails unless the response is 200 OK.
+func postJSON(url string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+	}
+
+	resp, err := client.Post(url, "application/json; charset=UTF-8", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer func(Body io.ReadCloser) { _ = Body.Close() }(resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s: %s", url, resp.Status, bytes.TrimSpace(body))
+	}
+
+	return nil
+}
+
+// injectFaults asks the metadata server to set faults on backends.
+func injectFaults(uri string, request InjectFaultsRequest) error {
+	return postJSON(fmt.Sprintf("%s/backends/faults", uri), request)
+}
+
+// applyTopologyEvent returns backendsByType updated by event.
+func applyTopologyEvent(backendsByType BoundBackendsByTrafficType, event TopologyEvent) BoundBackendsByTrafficType {
+	t := event.Backend.TrafficType
+	var backends []BoundBackend
+
+	for _, b := range backendsByType[t] {
+		if b.Name != event.Backend.Name {
+			backends = append(backends, b)
+		}
+	}
+	if event.Type == TopologyAdded {
+		backends = append(backends, event.Backend)
+	}
+
+	result := BoundBackendsByTrafficType{}
+	for k, v := range backendsByType {
+		result[k] = v
+	}
+	if len(backends) == 0 {
+		delete(result, t)
+	} else {
+		result[t] = backends
+	}
+	return result
+}
+
+// watchBackendMetadata follows the /backends/watch event stream and
+// calls onChange with the complete topology, first as it is now and
+// then after every change. Events that arrive together are coalesced
+// into a single call. It returns when ctx is done, the stream ends or
+// onChange returns an error.
+func watchBackendMetadata(ctx context.Context, uri string, onChange func(version uint64, backendsByType BoundBackendsByTrafficType) error) error {
+	url := fmt.Sprintf("%s/backends/watch", uri)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+	defer func(Body io.ReadCloser) { _ = Body.Close() }(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("/backends/watch request failed %v", resp.StatusCode)
+	}
+
+	var (
+		backendsByType BoundBackendsByTrafficType
+		version        uint64
+		event, data    string
+		reader         = bufio.NewReader(resp.Body)
+	)
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("%s: %w", url, err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		if strings.HasPrefix(line, "event:") {
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+			continue
+		}
+		if strings.HasPrefix(line, "data:") {
+			data = strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+			continue
+		}
+		if line != "" {
+			continue
+		}
+
+		// A blank line dispatches the event.
+		eventType, eventData := event, data
+		event, data = "", ""
+
+		switch eventType {
+		case "snapshot":
+			var snapshot TopologySnapshot
+			if err := json.Unmarshal([]byte(eventData), &snapshot); err != nil {
+				return err
+			}
+			backendsByType, version = snapshot.Backends, snapshot.Version
+		case TopologyAdded, TopologyRemoved:
+			var topologyEvent TopologyEvent
+			if err := json.Unmarshal([]byte(eventData), &topologyEvent); err != nil {
+				return err
+			}
+			backendsByType, version = applyTopologyEvent(backendsByType, topologyEvent), topologyEvent.Version
+		default:
+			continue
+		}
+
+		if reader.Buffered() > 0 {
+			// More events are already waiting.
+			continue
+		}
+
+		if err := onChange(version, backendsByType); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"fmt"
+	"path"
+	"text/template"
+)
+
+type NginxConfig struct {
+	Backends            []NginxBackendConfig
+	EnableHTTP2         bool
+	EnableLogging       bool
+	FailTimeoutInMillis int
+	HTTPPort            int
+	HTTPSPort           int
+	HTTPSPortSNIOnly    int
+	ListenPrefix        string
+	OutputDir           string
+	RootCAFile          string
+	SNIListen           string
+	TLSCertFile         string
+	TLSKeyFile          string
+	WorkerConnections   int
+	WorkerProcesses     int
+}
+
+type NginxBackendConfig struct {
+	BoundBackend
+	Spec *TrafficTypeSpec
+}
+
+//go:embed templates/nginx/nginx.conf.tmpl
+var nginxTemplate string
+
+func (c *GenNginxConfigCmd) Name() string {
+	return "nginx"
+}
+
+func (c *GenNginxConfigCmd) Run(p *ProgramCtx) error {
+	return runProxyConfigGenerator(p, c, false)
+}
+
+func (c *GenNginxConfigCmd) Generate(p *ProgramCtx, topology *ProxyTopology) error {
+	var backends []NginxBackendConfig
+
+	if err := topology.Route(func(b BoundBackend, spec *TrafficTypeSpec) error {
+		backends = append(backends, NginxBackendConfig{BoundBackend: b, Spec: spec})
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	config := NginxConfig{
+		Backends:      backends,
+		EnableHTTP2:   c.EnableHTTP2,
+		EnableLogging: c.EnableLogging,
+		// nginx (OSS) only has passive health checks.
+		FailTimeoutInMillis: c.HealthCheckIntervalInMillis,
+		HTTPPort:            p.HTTPPort,
+		HTTPSPort:           p.HTTPSPort,
+		HTTPSPortSNIOnly:    p.HTTPSPortSNIOnly,
+		OutputDir:           topology.OutputDir,
+		RootCAFile:          topology.CertPaths.RootCAFile,
+		TLSCertFile:         topology.CertPaths.TLSCertFile,
+		TLSKeyFile:          topology.CertPaths.TLSKeyFile,
+		WorkerConnections:   c.WorkerConnections,
+		WorkerProcesses:     c.WorkerProcesses,
+	}
+
+	if c.ListenAddress != "" {
+		config.ListenPrefix = c.ListenAddress + ":"
+	}
+
+	if c.UseUnixDomainSockets {
+		config.SNIListen = fmt.Sprintf("unix:%s/nginx-sni.sock", p.SocketDir)
+	} else {
+		config.SNIListen = "127.0.0.1:10444"
+	}
+
+	var nginxConf bytes.Buffer
+
+	if err := template.Must(template.New("nginx").Parse(nginxTemplate)).Execute(&nginxConf, config); err != nil {
+		return err
+	}
+
+	return createFile(path.Join(topology.Dir, "nginx.conf"), nginxConf.Bytes())
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// proxyStopTimeout is how long a proxy process may take to exit once
+// it is told to stop before it is killed.
+var proxyStopTimeout = 10 * time.Second
+
+// proxyProcesses runs a proxy that is reloaded by starting a new
+// process, which takes over from the current one while the old
+// processes finish serving their connections and exit.
+type proxyProcesses struct {
+	binary string
+	log    io.Writer
+
+	mu      sync.Mutex
+	running map[int]*exec.Cmd
+	current int
+}
+
+// state returns the current process, if any, and the pids of every
+// running process in order.
+func (ps *proxyProcesses) state() (int, []int) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	pids := make([]int, 0, len(ps.running))
+	for pid := range ps.running {
+		pids = append(pids, pid)
+	}
+	sort.Ints(pids)
+	return ps.current, pids
+}
+
+// start starts a new process with args and polls ready every 10ms,
+// for up to timeout, until the process has taken over. The process
+// is then current; otherwise it is killed.
+func (ps *proxyProcesses) start(args []string, timeout time.Duration, ready func(pid int) bool) error {
+	cmd := exec.Command(ps.binary, args...)
+	cmd.Stdout = ps.log
+	cmd.Stderr = ps.log
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Pdeathsig: syscall.SIGTERM,
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	pid := cmd.Process.Pid
+	exited := make(chan error, 1)
+
+	ps.mu.Lock()
+	if ps.running == nil {
+		ps.running = map[int]*exec.Cmd{}
+	}
+	ps.running[pid] = cmd
+	ps.mu.Unlock()
+
+	go func() {
+		err := cmd.Wait()
+		ps.mu.Lock()
+		delete(ps.running, pid)
+		ps.mu.Unlock()
+		exited <- err
+	}()
+
+	deadline := time.After(timeout)
+
+	for {
+		if ready(pid) {
+			ps.mu.Lock()
+			ps.current = pid
+			ps.mu.Unlock()
+			return nil
+		}
+		select {
+		case err := <-exited:
+			return fmt.Errorf("%s %s exited: %v", ps.binary, strings.Join(args, " "), err)
+		case <-deadline:
+			_ = cmd.Process.Kill()
+			return fmt.Errorf("%s %s did not take over within %v", ps.binary, strings.Join(args, " "), timeout)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// lingering returns the number of old processes still running.
+func (ps *proxyProcesses) lingering() int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	n := len(ps.running)
+	if _, ok := ps.running[ps.current]; ok {
+		n -= 1
+	}
+	return n
+}
+
+// stop terminates every process and waits for them to exit. Those
+// still running after proxyStopTimeout are killed.
+func (ps *proxyProcesses) stop() {
+	deadline := time.Now().Add(proxyStopTimeout)
+	terminated := map[int]bool{}
+	killed := false
+	for {
+		sig := syscall.SIGTERM
+		if time.Now().After(deadline) {
+			sig = syscall.SIGKILL
+		}
+		ps.mu.Lock()
+		n := len(ps.running)
+		if sig == syscall.SIGKILL && n > 0 && !killed {
+			log.Printf("%d %s processes did not exit within %v; killing them", n, ps.binary, proxyStopTimeout)
+			killed = true
+		}
+		for pid, cmd := range ps.running {
+			if sig == syscall.SIGKILL || !terminated[pid] {
+				_ = cmd.Process.Signal(sig)
+				terminated[pid] = true
+			}
+		}
+		ps.mu.Unlock()
+		if n == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
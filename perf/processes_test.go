@@ -0,0 +1,42 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestProxyProcessesStopKills(t *testing.T) {
+	defer func(timeout time.Duration) { proxyStopTimeout = timeout }(proxyStopTimeout)
+	proxyStopTimeout = 100 * time.Millisecond
+
+	trapped := path.Join(t.TempDir(), "trapped")
+	ps := &proxyProcesses{binary: "/bin/sh", log: io.Discard}
+	// An ignored signal stays ignored across exec.
+	if err := ps.start([]string{"-c", "trap '' TERM; touch " + trapped + "; exec sleep 60"}, 5*time.Second, func(int) bool {
+		_, err := os.Stat(trapped)
+		return err == nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	stopped := make(chan struct{})
+	go func() {
+		ps.stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(10 * time.Second):
+		t.Fatal("expected a process that ignores SIGTERM to be killed")
+	}
+	if elapsed := time.Since(start); elapsed < proxyStopTimeout {
+		t.Errorf("expected the process to be given %v to exit, killed after %v", proxyStopTimeout, elapsed)
+	}
+	if _, running := ps.state(); len(running) != 0 {
+		t.Errorf("expected every process to be stopped, got %v", running)
+	}
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+var errClientHelloPeeked = errors.New("client hello peeked")
+
+// proxyRoutes maps a hostname to the backend that serves it.
+type proxyRoutes struct {
+	mu       sync.RWMutex
+	backends map[string]BoundBackend
+	cert     *tls.Certificate
+	rootCAs  *x509.CertPool
+}
+
+func (r *proxyRoutes) update(backendsByTrafficType BoundBackendsByTrafficType, certBundle *Certificates) error {
+	cert, err := tls.X509KeyPair([]byte(certBundle.LeafCertPEM), []byte(certBundle.LeafKeyPEM))
+	if err != nil {
+		return err
+	}
+
+	rootCAs := x509.NewCertPool()
+	if !rootCAs.AppendCertsFromPEM([]byte(certBundle.RootCACertPEM)) {
+		return fmt.Errorf("failed to parse root CA certificate")
+	}
+
+	backends := map[string]BoundBackend{}
+	if err := routeBackends(backendsByTrafficType, func(b BoundBackend, _ *TrafficTypeSpec) error {
+		backends[b.Name] = b
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.backends = backends
+	r.cert = &cert
+	r.rootCAs = rootCAs
+	return nil
+}
+
+// lookup returns the backend for host if its traffic type has one
+// of the given port roles. DNS labels are case insensitive (RFC
+// 4343).
+func (r *proxyRoutes) lookup(host string, roles ...PortRole) (BoundBackend, bool) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	b, ok := r.backends[host]
+	if !ok {
+		return BoundBackend{}, false
+	}
+	for _, role := range roles {
+		if trafficTypes[b.TrafficType].PortRole == role {
+			return b, true
+		}
+	}
+	return BoundBackend{}, false
+}
+
+func (r *proxyRoutes) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+func (r *proxyRoutes) getRootCAs() *x509.CertPool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.rootCAs
+}
+
+// dial connects to a random endpoint of the backend named in addr
+// (<name>:<port>), like HAProxy's "balance random". Requests are
+// addressed to the backend's name so that the TLS server name used
+// for reencrypt backends is the route hostname rather than an
+// endpoint's IP address.
+func (r *proxyRoutes) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	b, ok := r.lookup(addr, HTTPPortRole, HTTPSPortRole, PassthroughPortRole)
+	if !ok || len(b.Endpoints) == 0 {
+		return nil, fmt.Errorf("no backend for %s", addr)
+	}
+	return dialEndpoint(ctx, network, b.Endpoints[rand.Intn(len(b.Endpoints))])
+}
+
+// dialSource connects to the endpoint of b chosen by hashing the
+// client's address, like HAProxy's "balance source".
+func (r *proxyRoutes) dialSource(ctx context.Context, b BoundBackend, source net.Addr) (net.Conn, error) {
+	if len(b.Endpoints) == 0 {
+		return nil, fmt.Errorf("no endpoints for %s", b.Name)
+	}
+	host, _, err := net.SplitHostPort(source.String())
+	if err != nil {
+		host = source.String()
+	}
+	h := fnv.New32a()
+	_, _ = io.WriteString(h, host)
+	return dialEndpoint(ctx, "tcp", b.Endpoints[h.Sum32()%uint32(len(b.Endpoints))])
+}
+
+// dialTLS connects to the reencrypt backend named in addr and
+// verifies it against the current root CA.
+func (r *proxyRoutes) dialTLS(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := r.dial(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	tlsConn := tls.Client(conn, &tls.Config{
+		RootCAs:    r.getRootCAs(),
+		ServerName: host,
+		NextProtos: []string{"h2", "http/1.1"},
+	})
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+func dialEndpoint(ctx context.Context, network string, e Endpoint) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, network, net.JoinHostPort(e.ListenAddress, fmt.Sprint(e.Port)))
+}
+
+// newReverseProxy proxies requests for routes reached on role's
+// ports. Requests for any other host get a 503, like HAProxy's
+// openshift_default backend.
+func (r *proxyRoutes) newReverseProxy(role PortRole) http.Handler {
+	transport := &http.Transport{
+		DialContext:         r.dial,
+		DialTLSContext:      r.dialTLS,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConnsPerHost: 32,
+		IdleConnTimeout:     90 * time.Second,
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			b, _ := r.lookup(req.Host, role)
+			req.URL.Scheme = "http"
+			if trafficTypes[b.TrafficType].BackendTLS == BackendReencrypt {
+				req.URL.Scheme = "https"
+			}
+			req.URL.Host = b.Name
+			req.Header.Set("X-Forwarded-Host", req.Host)
+		},
+		Transport: transport,
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if _, ok := r.lookup(req.Host, role); !ok {
+			http.Error(w, "no route", http.StatusServiceUnavailable)
+			return
+		}
+		proxy.ServeHTTP(w, req)
+	})
+}
+
+// readOnlyConn lets crypto/tls read a ClientHello without being able
+// to write a response.
+type readOnlyConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(b []byte) (int, error)  { return c.r.Read(b) }
+func (c readOnlyConn) Write(b []byte) (int, error) { return 0, io.ErrClosedPipe }
+
+// prefixConn replays the bytes consumed while peeking before
+// reading the rest of the connection.
+type prefixConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+
+func (c *prefixConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// peekServerName reads the TLS ClientHello on conn and returns the
+// SNI server name and a connection that replays it.
+func peekServerName(conn net.Conn) (string, net.Conn, error) {
+	var (
+		peeked     bytes.Buffer
+		serverName string
+	)
+
+	err := tls.Server(readOnlyConn{Conn: conn, r: io.TeeReader(conn, &peeked)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errClientHelloPeeked
+		},
+	}).Handshake()
+
+	if !errors.Is(err, errClientHelloPeeked) {
+		return "", nil, err
+	}
+
+	return serverName, &prefixConn{Conn: conn, r: io.MultiReader(&peeked, conn)}, nil
+}
+
+// splice copies between the client and backend until both
+// directions are done.
+func splice(client, backend net.Conn) {
+	var wg sync.WaitGroup
+
+	copyAndClose := func(dst, src net.Conn) {
+		defer wg.Done()
+		_, _ = io.Copy(dst, src)
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			_ = cw.CloseWrite()
+		} else {
+			_ = dst.Close()
+		}
+	}
+
+	wg.Add(2)
+	go copyAndClose(backend, client)
+	go copyAndClose(client, backend)
+	wg.Wait()
+
+	_ = client.Close()
+	_ = backend.Close()
+}
+
+// chanListener is a net.Listener fed with connections that have
+// already been accepted elsewhere.
+type chanListener struct {
+	addr  net.Addr
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func (l *chanListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *chanListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *chanListener) Addr() net.Addr { return l.addr }
+
+// serveSNI accepts connections on listener and splices those for
+// passthrough routes to their backend; everything else has TLS
+// terminated and is handed to terminated.
+func (c *ServeProxyCmd) serveSNI(ctx context.Context, listener net.Listener, routes *proxyRoutes, terminated *chanListener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		go func() {
+			_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			serverName, peekedConn, err := peekServerName(conn)
+			if err != nil {
+				_ = conn.Close()
+				return
+			}
+			_ = conn.SetReadDeadline(time.Time{})
+			conn = peekedConn
+
+			b, ok := routes.lookup(serverName, PassthroughPortRole)
+			if !ok {
+				select {
+				case terminated.conns <- conn:
+				case <-terminated.done:
+					_ = conn.Close()
+				}
+				return
+			}
+
+			backend, err := routes.dialSource(ctx, b, conn.RemoteAddr())
+			if err != nil {
+				log.Printf("%s: %v", serverName, err)
+				_ = conn.Close()
+				return
+			}
+
+			splice(conn, backend)
+		}()
+	}
+}
+
+func (c *ServeProxyCmd) Run(p *ProgramCtx) error {
+	routes := &proxyRoutes{}
+
+	refresh := func(backendsByTrafficType BoundBackendsByTrafficType) error {
+		// Certificates are reissued as backends are added.
+		certBundle, err := fetchCertficates(p.DiscoveryURL)
+		if err != nil {
+			return err
+		}
+		return routes.update(backendsByTrafficType, certBundle)
+	}
+
+	backendsByTrafficType, err := fetchAllBackendMetadata(p.DiscoveryURL)
+	if err != nil {
+		return err
+	}
+
+	if err := refresh(backendsByTrafficType); err != nil {
+		return err
+	}
+
+	tlsConfig := &tls.Config{
+		GetCertificate: routes.getCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+
+	var lc net.ListenConfig
+
+	httpListener, err := lc.Listen(p.Context, "tcp", net.JoinHostPort(c.ListenAddress, fmt.Sprint(p.HTTPPort)))
+	if err != nil {
+		return err
+	}
+
+	httpsListener, err := lc.Listen(p.Context, "tcp", net.JoinHostPort(c.ListenAddress, fmt.Sprint(p.HTTPSPort)))
+	if err != nil {
+		return err
+	}
+
+	sniOnlyListener, err := lc.Listen(p.Context, "tcp", net.JoinHostPort(c.ListenAddress, fmt.Sprint(p.HTTPSPortSNIOnly)))
+	if err != nil {
+		return err
+	}
+
+	terminated := &chanListener{
+		addr:  httpsListener.Addr(),
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+
+	httpServer := &http.Server{
+		Handler: routes.newReverseProxy(HTTPPortRole),
+	}
+
+	httpsServer := &http.Server{
+		Handler:   routes.newReverseProxy(HTTPSPortRole),
+		TLSConfig: tlsConfig,
+	}
+
+	g, gCtx := errgroup.WithContext(p.Context)
+
+	for _, s := range []struct {
+		server   *http.Server
+		listener net.Listener
+	}{
+		{httpServer, httpListener},
+		{httpsServer, tls.NewListener(terminated, tlsConfig)},
+		{httpsServer, tls.NewListener(sniOnlyListener, tlsConfig)},
+	} {
+		s := s
+		g.Go(func() error {
+			if err := s.server.Serve(s.listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				return err
+			}
+			return nil
+		})
+	}
+
+	g.Go(func() error {
+		return c.serveSNI(gCtx, httpsListener, routes, terminated)
+	})
+
+	if c.Watch {
+		g.Go(func() error {
+			return watchBackendMetadata(gCtx, p.DiscoveryURL, func(version uint64, backendsByTrafficType BoundBackendsByTrafficType) error {
+				log.Printf("routes updated to topology version %v", version)
+				return refresh(backendsByTrafficType)
+			})
+		})
+	}
+
+	g.Go(func() error {
+		<-gCtx.Done()
+		// Shutdown closes the listeners the servers accept
+		// from, terminated included; closing one first would
+		// have its Serve fail.
+		_ = httpsListener.Close()
+		shutdownCtx, shutdownRelease := context.WithTimeout(context.Background(), 5*time.Second)
+		defer shutdownRelease()
+		return errors.Join(httpServer.Shutdown(shutdownCtx), httpsServer.Shutdown(shutdownCtx))
+	})
+
+	log.Printf("proxy listening on ports %v (http), %v (https), %v (https, SNI only)", p.HTTPPort, p.HTTPSPort, p.HTTPSPortSNIOnly)
+
+	return g.Wait()
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// freePorts returns n ports that were free when it was called.
+func freePorts(t *testing.T, n int) []int {
+	var ports []int
+	for i := 0; i < n; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		ports = append(ports, l.Addr().(*net.TCPAddr).Port)
+	}
+	return ports
+}
+
+func TestServeProxy(t *testing.T) {
+	ports := freePorts(t, 4)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	g, gCtx := errgroup.WithContext(ctx)
+	defer func() {
+		// The metadata server waits for connections that never
+		// sent a request, such as a spare one the default
+		// client dialed, to be idle for five seconds.
+		http.DefaultClient.CloseIdleConnections()
+		cancel()
+		if err := g.Wait(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	p := &ProgramCtx{
+		Context: gCtx,
+		Globals: Globals{
+			DiscoveryURL:     fmt.Sprintf("http://127.0.0.1:%d", ports[0]),
+			HTTPPort:         ports[1],
+			HTTPSPort:        ports[2],
+			HTTPSPortSNIOnly: ports[3],
+			HostPrefix:       "test",
+			Nbackends:        1,
+			OutputDir:        t.TempDir(),
+			Port:             ports[0],
+		},
+	}
+
+	g.Go(func() error {
+		return (&ServeBackendsCmd{InProcess: true, ListenAddress: "127.0.0.1", Replicas: 2}).Run(p)
+	})
+
+	var backendsByTrafficType BoundBackendsByTrafficType
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		var err error
+		if backendsByTrafficType, err = fetchAllBackendMetadata(p.DiscoveryURL); err == nil && len(backendsByTrafficType) == len(AllTrafficTypes) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("backends not served: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	certBundle, err := fetchCertficates(p.DiscoveryURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootCAs := x509.NewCertPool()
+	if !rootCAs.AppendCertsFromPEM([]byte(certBundle.RootCACertPEM)) {
+		t.Fatal("failed to parse root CA certificate")
+	}
+
+	g.Go(func() error {
+		return (&ServeProxyCmd{ListenAddress: "127.0.0.1", Watch: true}).Run(p)
+	})
+
+	clients := map[int]*http.Client{}
+	for _, port := range []int{p.HTTPPort, p.HTTPSPort, p.HTTPSPortSNIOnly} {
+		port := port
+		clients[port] = &http.Client{
+			Timeout: 5 * time.Second,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, network, fmt.Sprintf("127.0.0.1:%d", port))
+				},
+				TLSClientConfig:   &tls.Config{RootCAs: rootCAs},
+				ForceAttemptHTTP2: true,
+			},
+		}
+		defer clients[port].CloseIdleConnections()
+	}
+
+	// get requests /healthz for host through the proxy port and
+	// returns the endpoint that served it.
+	get := func(host string, port int) (string, error) {
+		scheme := "https"
+		if port == p.HTTPPort {
+			scheme = "http"
+		}
+		resp, err := clients[port].Get(fmt.Sprintf("%s://%s%s", scheme, host, HealthCheckPath))
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return "", err
+		}
+		if resp.StatusCode != http.StatusOK || string(body) != "ok\n" {
+			return "", fmt.Errorf("%s: %s %q", host, resp.Status, body)
+		}
+		return resp.Header.Get(BackendEndpointHeader), nil
+	}
+
+	// expectRouted waits for the proxy to route host, on each of
+	// ports, to the backend's endpoints.
+	expectRouted := func(b BoundBackend, ports ...int) {
+		t.Helper()
+		for _, port := range ports {
+			deadline := time.Now().Add(10 * time.Second)
+			for {
+				endpoint, err := get(b.Name, port)
+				if err == nil && (endpoint == backendEndpointID(b.Name, 0) || endpoint == backendEndpointID(b.Name, 1)) {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("%s: port %d: expected to be routed to an endpoint, got %q, %v", b.Name, port, endpoint, err)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+	}
+
+	expectRouted(backendsByTrafficType[HTTPTraffic][0], p.HTTPPort)
+	expectRouted(backendsByTrafficType[EdgeTraffic][0], p.HTTPSPort, p.HTTPSPortSNIOnly)
+	expectRouted(backendsByTrafficType[ReencryptTraffic][0], p.HTTPSPort, p.HTTPSPortSNIOnly)
+	expectRouted(backendsByTrafficType[PassthroughTraffic][0], p.HTTPSPort)
+
+	if _, err := get("unknown", p.HTTPPort); err == nil {
+		t.Error("expected no route for an unknown host")
+	}
+
+	// A backend added later is routed with the reissued
+	// certificate that names it.
+	if err := postJSON(p.DiscoveryURL+"/backends/add", AddBackendsRequest{TrafficType: ReencryptTraffic, Count: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if backendsByTrafficType, err = fetchAllBackendMetadata(p.DiscoveryURL); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(backendsByTrafficType[ReencryptTraffic]); n != 2 {
+		t.Fatalf("expected 2 reencrypt backends, got %d", n)
+	}
+	expectRouted(backendsByTrafficType[ReencryptTraffic][1], p.HTTPSPort)
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+var errUnexpectedRegistration = errors.New("unexpected registration")
+
+const (
+	TopologyAdded   = "added"
+	TopologyRemoved = "removed"
+)
+
+// TopologyEvent records a backend joining or leaving the topology.
+// Version is the topology version after the change.
+type TopologyEvent struct {
+	Type    string       `json:"type"`
+	Version uint64       `json:"version"`
+	Backend BoundBackend `json:"backend"`
+}
+
+// TopologySnapshot is the complete topology at Version.
+type TopologySnapshot struct {
+	Version  uint64                     `json:"version"`
+	Backends BoundBackendsByTrafficType `json:"backends"`
+}
+
+// watchBufferSize bounds the events queued for a watcher. A watcher
+// that falls further behind is dropped and has to watch again,
+// starting from a new snapshot.
+const watchBufferSize = 1024
+
+// backendRegistry is the metadata server's view of the topology.
+// Backends are allocated a name first and become part of the
+// topology once they register the address they are listening on.
+type backendRegistry struct {
+	mu         sync.Mutex
+	hostPrefix string
+	backends   BackendsByTrafficType
+	bound      map[string]BoundBackend
+	registered map[string]chan struct{}
+	nextIndex  map[TrafficType]int
+	version    uint64
+	watchers   map[chan TopologyEvent]struct{}
+}
+
+func newBackendRegistry(hostPrefix string) *backendRegistry {
+	return &backendRegistry{
+		hostPrefix: hostPrefix,
+		backends:   BackendsByTrafficType{},
+		bound:      map[string]BoundBackend{},
+		registered: map[string]chan struct{}{},
+		nextIndex:  map[TrafficType]int{},
+		watchers:   map[chan TopologyEvent]struct{}{},
+	}
+}
+
+// allocate reserves n new backend names of traffic type t. Names
+// are never reused, even after a backend is removed.
+func (r *backendRegistry) allocate(t TrafficType, n int) []Backend {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var backends []Backend
+
+	for i := 0; i < n; i++ {
+		backend := Backend{
+			Name:        fmt.Sprintf("%s-%v-%v", r.hostPrefix, t, r.nextIndex[t]),
+			TrafficType: t,
+		}
+		r.nextIndex[t] += 1
+		r.backends[t] = append(r.backends[t], backend)
+		r.registered[backend.Name] = make(chan struct{})
+		backends = append(backends, backend)
+	}
+
+	return backends
+}
+
+// register records the address an allocated backend is listening
+// on.
+func (r *backendRegistry) register(boundBackend BoundBackend) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	registered, ok := r.registered[boundBackend.Name]
+	if !ok {
+		return errUnexpectedRegistration
+	}
+	if _, ok := r.bound[boundBackend.Name]; ok {
+		return errUnexpectedRegistration
+	}
+
+	r.bound[boundBackend.Name] = boundBackend
+	close(registered)
+	r.notify(TopologyAdded, boundBackend)
+	return nil
+}
+
+// waitForRegistration blocks until every backend in backends has
+// registered, ctx is done or timeout expires.
+func (r *backendRegistry) waitForRegistration(ctx context.Context, backends []Backend, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for _, b := range backends {
+		r.mu.Lock()
+		registered, ok := r.registered[b.Name]
+		r.mu.Unlock()
+		if !ok {
+			// removed before it registered
+			continue
+		}
+		select {
+		case <-registered:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+			return fmt.Errorf("timeout waiting for backends to register")
+		}
+	}
+
+	return nil
+}
+
+// remove deletes the named backend from the topology.
+func (r *backendRegistry) remove(name string) (Backend, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for t, backends := range r.backends {
+		for i, b := range backends {
+			if b.Name == name {
+				r.backends[t] = append(backends[:i:i], backends[i+1:]...)
+				if boundBackend, ok := r.bound[name]; ok {
+					delete(r.bound, name)
+					r.notify(TopologyRemoved, boundBackend)
+				}
+				delete(r.registered, name)
+				return b, true
+			}
+		}
+	}
+
+	return Backend{}, false
+}
+
+// newest returns up to n of the most recently allocated backends of
+// traffic type t.
+func (r *backendRegistry) newest(t TrafficType, n int) []Backend {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	backends := r.backends[t]
+	if n > len(backends) {
+		n = len(backends)
+	}
+	return append([]Backend(nil), backends[len(backends)-n:]...)
+}
+
+// names returns the name of every allocated backend.
+func (r *backendRegistry) names() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var names []string
+	for _, backends := range r.backends {
+		for _, b := range backends {
+			names = append(names, b.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// boundBackendsByTrafficType returns every registered backend.
+func (r *backendRegistry) boundBackendsByTrafficType() BoundBackendsByTrafficType {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.boundBackendsLocked()
+}
+
+func (r *backendRegistry) boundBackendsLocked() BoundBackendsByTrafficType {
+	result := BoundBackendsByTrafficType{}
+	for _, t := range AllTrafficTypes {
+		for _, b := range r.backends[t] {
+			if boundBackend, ok := r.bound[b.Name]; ok {
+				result[t] = append(result[t], boundBackend)
+			}
+		}
+	}
+	return result
+}
+
+// notify bumps the topology version and queues an event for every
+// watcher. The caller must hold r.mu.
+func (r *backendRegistry) notify(eventType string, boundBackend BoundBackend) {
+	r.version += 1
+
+	event := TopologyEvent{
+		Type:    eventType,
+		Version: r.version,
+		Backend: boundBackend,
+	}
+
+	for ch := range r.watchers {
+		select {
+		case ch <- event:
+		default:
+			delete(r.watchers, ch)
+			close(ch)
+		}
+	}
+}
+
+// watch returns the current topology and a channel of subsequent
+// changes. The channel is closed if the watcher falls behind; cancel
+// must be called once the watcher is no longer interested.
+func (r *backendRegistry) watch() (TopologySnapshot, <-chan TopologyEvent, func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ch := make(chan TopologyEvent, watchBufferSize)
+	r.watchers[ch] = struct{}{}
+
+	snapshot := TopologySnapshot{
+		Version:  r.version,
+		Backends: r.boundBackendsLocked(),
+	}
+
+	return snapshot, ch, func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if _, ok := r.watchers[ch]; ok {
+			delete(r.watchers, ch)
+			close(ch)
+		}
+	}
+}
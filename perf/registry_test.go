@@ -0,0 +1,53 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBackendRegistryWatch(t *testing.T) {
+	r := newBackendRegistry("test")
+
+	backends := r.allocate(EdgeTraffic, 2)
+	if err := r.register(BoundBackend{Backend: backends[0], Endpoints: []Endpoint{{ListenAddress: "127.0.0.1", Port: 1000}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot, events, cancel := r.watch()
+	defer cancel()
+
+	if snapshot.Version != 1 || len(snapshot.Backends[EdgeTraffic]) != 1 {
+		t.Fatalf("unexpected snapshot %+v", snapshot)
+	}
+
+	if err := r.register(BoundBackend{Backend: backends[1], Endpoints: []Endpoint{{ListenAddress: "127.0.0.1", Port: 1001}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.register(BoundBackend{Backend: backends[1], Endpoints: []Endpoint{{ListenAddress: "127.0.0.1", Port: 1001}}}); err != errUnexpectedRegistration {
+		t.Fatalf("expected %v, got %v", errUnexpectedRegistration, err)
+	}
+	if _, ok := r.remove(backends[0].Name); !ok {
+		t.Fatalf("expected %s to be removed", backends[0].Name)
+	}
+
+	backendsByType := snapshot.Backends
+	for _, expected := range []TopologyEvent{
+		{Type: TopologyAdded, Version: 2, Backend: BoundBackend{Backend: backends[1], Endpoints: []Endpoint{{ListenAddress: "127.0.0.1", Port: 1001}}}},
+		{Type: TopologyRemoved, Version: 3, Backend: BoundBackend{Backend: backends[0], Endpoints: []Endpoint{{ListenAddress: "127.0.0.1", Port: 1000}}}},
+	} {
+		if event := <-events; !reflect.DeepEqual(event, expected) {
+			t.Fatalf("expected %+v, got %+v", expected, event)
+		} else {
+			backendsByType = applyTopologyEvent(backendsByType, event)
+		}
+	}
+
+	current := r.boundBackendsByTrafficType()
+	if len(backendsByType[EdgeTraffic]) != 1 || !reflect.DeepEqual(backendsByType[EdgeTraffic][0], current[EdgeTraffic][0]) {
+		t.Errorf("expected %+v, got %+v", current, backendsByType)
+	}
+
+	if next := r.allocate(EdgeTraffic, 1); next[0].Name != "test-edge-2" {
+		t.Errorf("expected names not to be reused, got %s", next[0].Name)
+	}
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// haproxyStatsSocket is the stats socket configured by
+// globals.tmpl.
+func haproxyStatsSocket(p *ProgramCtx) string {
+	return path.Join(p.SocketDir, "haproxy.sock")
+}
+
+// haproxyInfo returns the output of "show info" on the stats socket.
+func haproxyInfo(socket string) (map[string]string, error) {
+	conn, err := net.DialTimeout("unix", socket, time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		return nil, err
+	}
+	if _, err := io.WriteString(conn, "show info\n"); err != nil {
+		return nil, err
+	}
+
+	info := map[string]string{}
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		if k, v, ok := strings.Cut(scanner.Text(), ":"); ok {
+			info[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+	}
+	return info, scanner.Err()
+}
+
+// haproxyProcesses runs HAProxy and reloads it the way the OpenShift
+// router does: each reload starts a new process that takes the
+// listening sockets from the current one over the stats socket (-x)
+// and asks the old processes to finish serving their connections
+// and exit (-sf).
+type haproxyProcesses struct {
+	proxyProcesses
+
+	config string
+	socket string
+}
+
+// reload starts a new HAProxy process, replacing any running ones,
+// and waits up to timeout for it to answer on the stats socket.
+func (h *haproxyProcesses) reload(timeout time.Duration) error {
+	current, running := h.state()
+
+	args := []string{"-f", h.config}
+	if current != 0 {
+		args = append(args, "-x", h.socket)
+	}
+	if len(running) > 0 {
+		args = append(args, "-sf")
+		for _, pid := range running {
+			args = append(args, strconv.Itoa(pid))
+		}
+	}
+
+	return h.start(args, timeout, func(pid int) bool {
+		info, err := haproxyInfo(h.socket)
+		return err == nil && info["Pid"] == strconv.Itoa(pid)
+	})
+}
+
+// isConnectionReset reports whether err is the proxy closing or
+// resetting a connection under a request.
+func isConnectionReset(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// reloadSample is what the workload saw of one reload, from the
+// reload starting until the next one does.
+type reloadSample struct {
+	Started  time.Time
+	Duration time.Duration
+
+	// Failed requests errored or had a bad status; Reset of
+	// them lost their connection.
+	Failed int
+	Reset  int
+
+	// Lingering is the number of old processes still running
+	// when the next reload started, or the test ended.
+	Lingering int
+
+	Err error
+}
+
+// reloadReport attributes each request failure to the reload that
+// preceded it.
+type reloadReport struct {
+	start    time.Time
+	baseline reloadSample
+	samples  []*reloadSample
+}
+
+func (r *reloadReport) sampleAt(t time.Time) *reloadSample {
+	for i := len(r.samples) - 1; i >= 0; i-- {
+		if !t.Before(r.samples[i].Started) {
+			return r.samples[i]
+		}
+	}
+	return &r.baseline
+}
+
+func (r *reloadReport) record(t time.Time, result *fetchResult) {
+	sample := r.sampleAt(t)
+	switch {
+	case result.err != nil:
+		sample.Failed += 1
+		if isConnectionReset(result.err) {
+			sample.Reset += 1
+		}
+	case result.status != result.expected:
+		sample.Failed += 1
+	}
+}
+
+func (r *reloadReport) write(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+
+	if _, err := fmt.Fprintln(tw, "reload\tat\tduration\tfailed\treset\tlingering"); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(tw, "none\t0s\t-\t%d\t%d\t-\n", r.baseline.Failed, r.baseline.Reset); err != nil {
+		return err
+	}
+
+	var (
+		durations    []float64
+		failed       int
+		reset        int
+		maxLingering int
+	)
+
+	for i, s := range r.samples {
+		duration := "failed: " + fmt.Sprint(s.Err)
+		if s.Err == nil {
+			duration = s.Duration.Round(time.Microsecond).String()
+			durations = append(durations, float64(s.Duration)/float64(time.Millisecond))
+		}
+		if _, err := fmt.Fprintf(tw, "%d\t%v\t%s\t%d\t%d\t%d\n", i+1, s.Started.Sub(r.start).Round(time.Millisecond), duration, s.Failed, s.Reset, s.Lingering); err != nil {
+			return err
+		}
+		failed += s.Failed
+		reset += s.Reset
+		if s.Lingering > maxLingering {
+			maxLingering = s.Lingering
+		}
+	}
+
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	if len(r.samples) == 0 {
+		return nil
+	}
+
+	var p50, max float64
+	if len(durations) > 0 {
+		sort.Float64s(durations)
+		p50, max = median(durations), durations[len(durations)-1]
+	}
+
+	_, err := fmt.Fprintf(w, "reloads: %d duration_p50_ms: %.3f duration_max_ms: %.3f failed_per_reload: %.2f reset_per_reload: %.2f max_lingering: %d\n",
+		len(r.samples), p50, max, float64(failed)/float64(len(r.samples)), float64(reset)/float64(len(r.samples)), maxLingering)
+	return err
+}
+
+func (c *ReloadTestCmd) Run(p *ProgramCtx) error {
+	return c.run(p, os.Stdout)
+}
+
+// run starts HAProxy, then runs the workload in RequestFile while
+// reloading HAProxy, and writes a reloadReport to out.
+func (c *ReloadTestCmd) run(p *ProgramCtx, out io.Writer) error {
+	if c.Interval <= 0 && !c.OnTopologyChange {
+		return errors.New("reload on an --interval or --on-topology-change")
+	}
+
+	requests, err := readMBRequests(c.RequestFile)
+	if err != nil {
+		return err
+	}
+
+	proxy := c.Proxy
+	proxy.Watch = false
+
+	if err := runProxyConfigGenerator(p, &proxy, false); err != nil {
+		return err
+	}
+
+	logFile, err := os.Create(path.Join(p.OutputDir, "haproxy-reload-test.log"))
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+
+	haproxy := &haproxyProcesses{
+		proxyProcesses: proxyProcesses{
+			binary: c.HAProxy,
+			log:    logFile,
+		},
+		config: path.Join(p.OutputDir, proxy.Name(), "haproxy.cfg"),
+		socket: haproxyStatsSocket(p),
+	}
+	defer haproxy.stop()
+
+	if err := haproxy.reload(c.ReloadTimeout); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(p.Context)
+	defer cancel()
+
+	resultCh := make(chan *fetchResult)
+
+	if err := startMBClients(ctx, requests, p.defaultPort, false, 0, false, resultCh); err != nil {
+		return err
+	}
+
+	type reloadEvent struct {
+		started  time.Time
+		duration time.Duration
+		done     bool
+		err      error
+	}
+
+	reloadCh := make(chan reloadEvent)
+
+	reload := func() {
+		started := time.Now()
+		select {
+		case reloadCh <- reloadEvent{started: started}:
+		case <-ctx.Done():
+			return
+		}
+		err := haproxy.reload(c.ReloadTimeout)
+		select {
+		case reloadCh <- reloadEvent{started: started, duration: time.Since(started), done: true, err: err}:
+		case <-ctx.Done():
+		}
+	}
+
+	reloaderErr := make(chan error, 1)
+
+	go func() {
+		if !c.OnTopologyChange {
+			ticker := time.NewTicker(c.Interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					reload()
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+
+		first := true
+		reloaderErr <- watchBackendMetadata(ctx, p.DiscoveryURL, func(version uint64, backendsByTrafficType BoundBackendsByTrafficType) error {
+			// The configuration was generated for the
+			// current topology before the test started.
+			if first {
+				first = false
+				return nil
+			}
+			if err := generateProxyConfig(p, &proxy, version, backendsByTrafficType); err != nil {
+				return err
+			}
+			log.Printf("reloading for topology version %v", version)
+			reload()
+			return nil
+		})
+	}()
+
+	report := &reloadReport{start: time.Now()}
+	latencies := newLatencyReport()
+	hits := 0
+	fetchErrors := 0
+	fetchBadStatus := 0
+	testComplete := time.After(c.Duration)
+
+	for {
+		select {
+		case <-p.Context.Done():
+			return errors.New("test interrupted")
+
+		case err := <-reloaderErr:
+			if err == nil {
+				err = errors.New("topology watch ended")
+			}
+			return err
+
+		case event := <-reloadCh:
+			if !event.done {
+				if n := len(report.samples); n > 0 {
+					report.samples[n-1].Lingering = haproxy.lingering()
+				}
+				report.samples = append(report.samples, &reloadSample{Started: event.started})
+				continue
+			}
+			sample := report.sampleAt(event.started)
+			sample.Duration = event.duration
+			sample.Err = event.err
+			if event.err != nil {
+				log.Printf("reload failed: %v", event.err)
+			}
+
+		case result := <-resultCh:
+			hits += 1
+			report.record(time.Now(), result)
+			if result.err != nil {
+				fetchErrors += 1
+				continue
+			}
+			latencies.Record(result.host, result.latency)
+			if result.status != result.expected {
+				fetchBadStatus += 1
+			}
+
+		case <-testComplete:
+			cancel()
+			if n := len(report.samples); n > 0 {
+				report.samples[n-1].Lingering = haproxy.lingering()
+			}
+			if _, err := fmt.Fprintf(out, "hits: %v errors: %v bad_status: %v request/s: %.2f\n", hits, fetchErrors, fetchBadStatus, float64(hits)/float64(c.Duration.Seconds())); err != nil {
+				return err
+			}
+			if err := latencies.Write(out); err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintln(out); err != nil {
+				return err
+			}
+			return report.write(out)
+		}
+	}
+}
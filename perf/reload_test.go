@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeHAProxyEnv makes the test binary act as HAProxy, serving "show
+// info" on the socket it names, for TestHAProxyProcesses.
+const fakeHAProxyEnv = "PERF_TEST_FAKE_HAPROXY_SOCKET"
+
+// fakeHAProxyWorkerEnv makes the test binary act as a worker of a
+// fake HAProxy master.
+const fakeHAProxyWorkerEnv = "PERF_TEST_FAKE_HAPROXY_WORKER"
+
+func init() {
+	if os.Getenv(fakeHAProxyWorkerEnv) != "" {
+		fakeHAProxyWorker()
+		os.Exit(0)
+	}
+	if socket := os.Getenv(fakeHAProxyEnv); socket != "" {
+		fakeHAProxy(socket, os.Args[1:])
+		os.Exit(0)
+	}
+}
+
+// fakeHAProxyWorker runs until it is stopped or its master exits.
+func fakeHAProxyWorker() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGTERM)
+	<-signals
+}
+
+// startFakeHAProxyWorker starts a worker process of this master.
+func startFakeHAProxyWorker() (*exec.Cmd, error) {
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), fakeHAProxyWorkerEnv+"=1")
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Pdeathsig: syscall.SIGTERM,
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	go func() {
+		_ = cmd.Wait()
+	}()
+	return cmd, nil
+}
+
+// fakeHAProxy takes over socket and soft stops the processes named
+// by -sf, which linger for a while before exiting. With -W it is a
+// master that starts a worker, a child process that it reports on
+// the socket, and a new one on SIGUSR2; it takes a while to start
+// the first.
+func fakeHAProxy(socket string, args []string) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGTERM)
+
+	masterWorker := len(args) > 0 && args[0] == "-W"
+
+	var worker atomic.Value
+	worker.Store(os.Getpid())
+
+	if masterWorker {
+		time.Sleep(200 * time.Millisecond)
+		cmd, err := startFakeHAProxyWorker()
+		if err != nil {
+			os.Exit(1)
+		}
+		worker.Store(cmd.Process.Pid)
+	}
+
+	_ = os.Remove(socket)
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		os.Exit(1)
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = bufio.NewReader(conn).ReadString('\n')
+			fmt.Fprintf(conn, "Name: HAProxy\nPid: %d\n", worker.Load())
+			conn.Close()
+		}
+	}()
+
+	for i, arg := range args {
+		if arg != "-sf" {
+			continue
+		}
+		for _, pid := range args[i+1:] {
+			if n, err := strconv.Atoi(pid); err == nil {
+				_ = syscall.Kill(n, syscall.SIGUSR1)
+			}
+		}
+	}
+
+	for {
+		switch <-signals {
+		case syscall.SIGUSR1:
+			time.Sleep(500 * time.Millisecond)
+			return
+		case syscall.SIGUSR2:
+			old := worker.Load().(int)
+			cmd, err := startFakeHAProxyWorker()
+			if err != nil {
+				continue
+			}
+			worker.Store(cmd.Process.Pid)
+			_ = syscall.Kill(old, syscall.SIGUSR1)
+		default:
+			if pid := worker.Load().(int); pid != os.Getpid() {
+				_ = syscall.Kill(pid, syscall.SIGTERM)
+			}
+			return
+		}
+	}
+}
+
+func TestHAProxyProcesses(t *testing.T) {
+	socket := path.Join(t.TempDir(), "haproxy.sock")
+	t.Setenv(fakeHAProxyEnv, socket)
+
+	h := &haproxyProcesses{
+		proxyProcesses: proxyProcesses{
+			binary: os.Args[0],
+			log:    io.Discard,
+		},
+		config: "haproxy.cfg",
+		socket: socket,
+	}
+	defer h.stop()
+
+	for i := 0; i < 3; i++ {
+		if err := h.reload(5 * time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The process soft stopped by the last reload lingers;
+	// earlier ones may already have exited.
+	if n := h.lingering(); n < 1 || n > 2 {
+		t.Errorf("expected 1 or 2 lingering processes, got %d", n)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for h.lingering() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected old processes to exit, got %d", h.lingering())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	info, err := haproxyInfo(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current, _ := h.state(); info["Pid"] != strconv.Itoa(current) {
+		t.Errorf("expected the current process to own the socket, got %v", info)
+	}
+
+	h.stop()
+	if _, running := h.state(); len(running) != 0 {
+		t.Errorf("expected every process to be stopped, got %v", running)
+	}
+}
+
+func TestReloadReport(t *testing.T) {
+	start := time.Now()
+	at := func(ms int) time.Time {
+		return start.Add(time.Duration(ms) * time.Millisecond)
+	}
+
+	report := &reloadReport{
+		start: start,
+		samples: []*reloadSample{
+			{Started: at(1000), Duration: 20 * time.Millisecond, Lingering: 1},
+			{Started: at(2000), Duration: 40 * time.Millisecond},
+		},
+	}
+
+	for _, r := range []struct {
+		ms     int
+		result fetchResult
+	}{
+		{500, fetchResult{err: errors.New("timeout")}},
+		{1100, fetchResult{err: io.EOF}},
+		{1200, fetchResult{err: syscall.ECONNRESET}},
+		{1300, fetchResult{status: 503, expected: 200}},
+		{1400, fetchResult{status: 200, expected: 200}},
+		{2100, fetchResult{status: 404, expected: 404}},
+		{2200, fetchResult{err: io.ErrUnexpectedEOF}},
+	} {
+		report.record(at(r.ms), &r.result)
+	}
+
+	var out strings.Builder
+	if err := report.write(&out); err != nil {
+		t.Fatal(err)
+	}
+
+	var rows [][]string
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		rows = append(rows, strings.Fields(line))
+	}
+
+	for _, tc := range []struct {
+		row      int
+		expected string
+	}{
+		{1, "none 0s - 1 0 -"},
+		{2, "1 1s 20ms 3 2 1"},
+		{3, "2 2s 40ms 1 1 0"},
+		{4, "reloads: 2 duration_p50_ms: 30.000 duration_max_ms: 40.000 failed_per_reload: 2.00 reset_per_reload: 1.50 max_lingering: 1"},
+	} {
+		if got := strings.Join(rows[tc.row], " "); got != tc.expected {
+			t.Errorf("row %d: expected %q, got %q", tc.row, tc.expected, got)
+		}
+	}
+}
@@ -25,6 +25,7 @@ type MBRequest struct {
 type MBRequestConfig struct {
 	Clients           int
 	KeepAliveRequests int
+	Paths             []string
 	TLSSessionReuse   bool
 	TrafficTypes      []TrafficType
 }
@@ -39,69 +40,108 @@ func filterInTrafficByType(types []TrafficType, backendsMap BoundBackendsByTraff
 	return result
 }
 
-type portSelector func(b BoundBackend, cfg Globals) int
+type trafficRequestConfig struct {
+	Name         string
+	TrafficTypes []TrafficType
+}
+
+// trafficRequestConfigs returns a request file for each traffic
+// type and one, "mix", for all of them.
+func trafficRequestConfigs() []trafficRequestConfig {
+	result := []trafficRequestConfig{{"mix", AllTrafficTypes}}
+	for _, t := range AllTrafficTypes {
+		result = append(result, trafficRequestConfig{string(t), []TrafficType{t}})
+	}
+	return result
+}
+
+// portSelector returns the ports requests for b are sent to: the
+// proxy's, or each of b's endpoints when going direct.
+type portSelector func(b BoundBackend, cfg Globals) []int
 type schemeSelector func(t TrafficType) string
 
-func haproxyPortSelector(b BoundBackend, cfg Globals) int {
-	switch b.TrafficType {
-	case HTTPTraffic:
-		return cfg.HTTPPort
-	default:
-		return cfg.HTTPSPort
+func haproxyPortSelector(b BoundBackend, cfg Globals) []int {
+	if trafficTypes[b.TrafficType].PortRole == HTTPPortRole {
+		return []int{cfg.HTTPPort}
 	}
+	return []int{cfg.HTTPSPort}
 }
 
-func haproxySNIOnlyPortSelector(b BoundBackend, cfg Globals) int {
-	switch b.TrafficType {
-	case HTTPTraffic:
-		return cfg.HTTPPort
-	default:
-		return cfg.HTTPSPortSNIOnly
+func haproxySNIOnlyPortSelector(b BoundBackend, cfg Globals) []int {
+	if trafficTypes[b.TrafficType].PortRole == HTTPPortRole {
+		return []int{cfg.HTTPPort}
 	}
+	return []int{cfg.HTTPSPortSNIOnly}
 }
 
 func haproxySchemeSelector(t TrafficType) string {
-	switch t {
-	case HTTPTraffic:
-		return "http"
-	default:
-		return "https"
-	}
+	return trafficTypes[t].Scheme
 }
 
-func directPortSelector(b BoundBackend, cfg Globals) int {
-	return b.Port
+func directPortSelector(b BoundBackend, cfg Globals) []int {
+	var ports []int
+	for _, e := range b.Endpoints {
+		ports = append(ports, e.Port)
+	}
+	return ports
 }
 
 func directSchemeSelector(t TrafficType) string {
-	switch t {
-	case HTTPTraffic, EdgeTraffic:
+	if trafficTypes[t].BackendTLS == BackendPlain {
 		return "http"
-	default:
-		return "https"
 	}
+	return "https"
 }
 
+// generateMBRequests returns cfg.Clients clients for each backend
+// and port, split between cfg.Paths. Where the clients do not split
+// evenly the extra ones go to different paths for each backend, so
+// that every path is requested even with fewer clients than paths.
 func generateMBRequests(p *ProgramCtx, portSelector portSelector, schemeSelector schemeSelector, cfg MBRequestConfig, backends []BoundBackend) []MBRequest {
 	var requests []MBRequest
 
-	for _, b := range backends {
-		requests = append(requests, MBRequest{
-			Clients:           cfg.Clients,
-			Host:              b.Name,
-			KeepAliveRequests: cfg.KeepAliveRequests,
-			Method:            "GET",
-			Path:              "/1024.html",
-			Port:              portSelector(b, p.Globals),
-			Scheme:            schemeSelector(b.TrafficType),
-			TLSSessionReuse:   cfg.TLSSessionReuse,
-		})
+	for i, b := range backends {
+		for _, port := range portSelector(b, p.Globals) {
+			for j, path := range cfg.Paths {
+				clients := cfg.Clients / len(cfg.Paths)
+				if (j+len(cfg.Paths)-i%len(cfg.Paths))%len(cfg.Paths) < cfg.Clients%len(cfg.Paths) {
+					clients += 1
+				}
+				if clients == 0 {
+					continue
+				}
+				requests = append(requests, MBRequest{
+					Clients:           clients,
+					Host:              b.Name,
+					KeepAliveRequests: cfg.KeepAliveRequests,
+					Method:            "GET",
+					Path:              path,
+					Port:              port,
+					Scheme:            schemeSelector(b.TrafficType),
+					TLSSessionReuse:   cfg.TLSSessionReuse,
+				})
+			}
+		}
 	}
 
 	return requests
 }
 
 func (c *GenWorkloadCmd) Run(p *ProgramCtx) error {
+	responses := c.Responses
+	if len(responses) == 0 {
+		responses = []string{staticResponse}
+	}
+
+	var paths []string
+	for _, response := range responses {
+		path, err := responsePath(response)
+		if err != nil {
+			return err
+		}
+		paths = append(paths, path)
+	}
+
 	basedir := path.Join(p.OutputDir, "requests")
 	if err := os.RemoveAll(basedir); err != nil {
 		return err
@@ -122,28 +162,21 @@ func (c *GenWorkloadCmd) Run(p *ProgramCtx) error {
 		{"haproxy", true, haproxyPortSelector, haproxySchemeSelector},
 		{"haproxy-reencrypt-only", true, haproxySNIOnlyPortSelector, haproxySchemeSelector},
 	} {
-		for _, clients := range []int{1, 2, 5, 10, 50, 75, 80, 90, 100, 200} {
-			for _, requestCfg := range []struct {
-				Name         string
-				TrafficTypes []TrafficType
-			}{
-				{"edge", []TrafficType{EdgeTraffic}},
-				{"http", []TrafficType{HTTPTraffic}},
-				{"mix", AllTrafficTypes[:]},
-				{"passthrough", []TrafficType{PassthroughTraffic}},
-				{"reencrypt", []TrafficType{ReencryptTraffic}},
-			} {
+		for _, clients := range c.Clients {
+			for _, requestCfg := range trafficRequestConfigs() {
 				if workload.subdir == "haproxy-reencrypt-only" && requestCfg.Name != "reencrypt" {
 					continue
 				}
-				for _, keepAliveRequests := range []int{0} {
+				for _, keepAliveRequests := range c.KeepAliveRequests {
 					config := MBRequestConfig{
 						Clients:           clients,
 						KeepAliveRequests: keepAliveRequests,
+						Paths:             paths,
 						TLSSessionReuse:   p.TLSReuse,
 						TrafficTypes:      requestCfg.TrafficTypes,
 					}
-					requests := generateMBRequests(p, workload.portSelector, workload.schemeSelector, config, filterInTrafficByType(requestCfg.TrafficTypes, backendsByTrafficType))
+					backends := filterInTrafficByType(requestCfg.TrafficTypes, backendsByTrafficType)
+					requests := generateMBRequests(p, workload.portSelector, workload.schemeSelector, config, backends)
 					data, err := json.MarshalIndent(requests, "", "  ")
 					if err != nil {
 						return err
@@ -152,7 +185,7 @@ func (c *GenWorkloadCmd) Run(p *ProgramCtx) error {
 						basedir,
 						workload.subdir,
 						requestCfg.Name,
-						len(requests),
+						len(backends),
 						config.Clients,
 						config.KeepAliveRequests)
 					if err := createFile(filepath, data); err != nil {
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestGenerateMBRequestsSplitsClients(t *testing.T) {
+	var backends []BoundBackend
+	for i := 0; i < 3; i++ {
+		backends = append(backends, BoundBackend{
+			Backend: Backend{Name: fmt.Sprintf("b-%d", i), TrafficType: HTTPTraffic},
+		})
+	}
+	p := &ProgramCtx{Globals: Globals{HTTPPort: 8080}}
+	paths := []string{"/a", "/b", "/c"}
+
+	for _, tc := range []struct {
+		clients  int
+		expected map[string]int // host+path: clients
+	}{
+		{6, map[string]int{
+			"b-0/a": 2, "b-0/b": 2, "b-0/c": 2,
+			"b-1/a": 2, "b-1/b": 2, "b-1/c": 2,
+			"b-2/a": 2, "b-2/b": 2, "b-2/c": 2,
+		}},
+		{4, map[string]int{
+			"b-0/a": 2, "b-0/b": 1, "b-0/c": 1,
+			"b-1/a": 1, "b-1/b": 2, "b-1/c": 1,
+			"b-2/a": 1, "b-2/b": 1, "b-2/c": 2,
+		}},
+		{1, map[string]int{"b-0/a": 1, "b-1/b": 1, "b-2/c": 1}},
+	} {
+		cfg := MBRequestConfig{Clients: tc.clients, Paths: paths}
+		got := map[string]int{}
+		perBackend := map[string]int{}
+		for _, r := range generateMBRequests(p, haproxyPortSelector, haproxySchemeSelector, cfg, backends) {
+			got[r.Host+r.Path] = r.Clients
+			perBackend[r.Host] += r.Clients
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tc.expected) {
+			t.Errorf("%d clients: expected %v, got %v", tc.clients, tc.expected, got)
+		}
+		for host, n := range perBackend {
+			if n != tc.clients {
+				t.Errorf("%d clients: %s has %d clients", tc.clients, host, n)
+			}
+		}
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ResponsePath is where backends serve synthetic responses, which
+// are described by the request's query string (see ResponseSpec).
+const ResponsePath = "/response"
+
+// maxResponseSize bounds the body a synthetic response may ask for,
+// as each body is built in memory.
+const maxResponseSize = 64 << 20
+
+// maxCachedResponseBytes bounds the memory kept for bodies that have
+// been served before; bodies beyond it are built per request.
+const maxCachedResponseBytes = 256 << 20
+
+// ResponseSpec describes a synthetic response.
+type ResponseSpec struct {
+	// Size is the length of the body before any compression.
+	Size int
+
+	// Delay is how long the backend waits before responding,
+	// plus a random extra of up to Jitter.
+	Delay  time.Duration
+	Jitter time.Duration
+
+	// Chunks, if non-zero, is the number of pieces the body is
+	// written in, each flushed as it is written and separated by
+	// ChunkDelay. The response is then chunked, not sized.
+	Chunks     int
+	ChunkDelay time.Duration
+
+	// Gzip compresses the body for clients that accept it.
+	Gzip bool
+
+	// Status is the response's status code; 0 means 200.
+	Status int
+}
+
+// Path returns the path that asks a backend for s.
+func (s ResponseSpec) Path() string {
+	q := url.Values{}
+	q.Set("size", strconv.Itoa(s.Size))
+	if s.Delay > 0 {
+		q.Set("delay", s.Delay.String())
+	}
+	if s.Jitter > 0 {
+		q.Set("jitter", s.Jitter.String())
+	}
+	if s.Chunks > 0 {
+		q.Set("chunks", strconv.Itoa(s.Chunks))
+	}
+	if s.ChunkDelay > 0 {
+		q.Set("chunk-delay", s.ChunkDelay.String())
+	}
+	if s.Gzip {
+		q.Set("gzip", "true")
+	}
+	if s.Status != 0 {
+		q.Set("status", strconv.Itoa(s.Status))
+	}
+	return ResponsePath + "?" + q.Encode()
+}
+
+// ExpectedStatus is the status code a client should expect for s.
+func (s ResponseSpec) ExpectedStatus() int {
+	if s.Status == 0 {
+		return http.StatusOK
+	}
+	return s.Status
+}
+
+func parseResponseSpec(q url.Values) (ResponseSpec, error) {
+	var s ResponseSpec
+	var err error
+
+	parseInt := func(name string, min, max int) int {
+		v := q.Get(name)
+		if v == "" || err != nil {
+			return 0
+		}
+		var n int
+		if n, err = strconv.Atoi(v); err == nil && (n < min || n > max) {
+			err = fmt.Errorf("%s must be between %d and %d", name, min, max)
+		}
+		return n
+	}
+
+	parseDuration := func(name string) time.Duration {
+		v := q.Get(name)
+		if v == "" || err != nil {
+			return 0
+		}
+		var d time.Duration
+		if d, err = time.ParseDuration(v); err == nil && d < 0 {
+			err = fmt.Errorf("%s must not be negative", name)
+		}
+		return d
+	}
+
+	s.Size = parseInt("size", 0, maxResponseSize)
+	s.Delay = parseDuration("delay")
+	s.Jitter = parseDuration("jitter")
+	s.Chunks = parseInt("chunks", 0, maxResponseSize)
+	s.ChunkDelay = parseDuration("chunk-delay")
+	s.Status = parseInt("status", 0, 599)
+	if s.Status != 0 && s.Status < 200 {
+		err = fmt.Errorf("status must be between 200 and 599")
+	}
+	if s.Status == http.StatusNoContent || s.Status == http.StatusNotModified {
+		err = fmt.Errorf("status %d cannot have a body", s.Status)
+	}
+	if v := q.Get("gzip"); v != "" && err == nil {
+		s.Gzip, err = strconv.ParseBool(v)
+	}
+
+	return s, err
+}
+
+// responseFiller is the text synthetic bodies are made from, so
+// that they compress like a typical page rather than not at all.
+var responseFiller = func() []byte {
+	data, err := BackendFS.ReadFile("1024.html")
+	if err != nil {
+		panic(err)
+	}
+	return data
+}()
+
+// responseBody returns the first size bytes of responseFiller
+// repeated.
+func responseBody(size int) []byte {
+	body := make([]byte, size)
+	for i := 0; i < size; i += len(responseFiller) {
+		copy(body[i:], responseFiller)
+	}
+	return body
+}
+
+type responseBodyKey struct {
+	size int
+	gzip bool
+}
+
+var responseBodies = struct {
+	sync.Mutex
+	bodies map[responseBodyKey][]byte
+	bytes  int
+}{bodies: map[responseBodyKey][]byte{}}
+
+// cachedResponseBody returns the body of size bytes, compressed if
+// gzipped is set. It is built and compressed once, on first use, so
+// that serving it again costs no more than writing it.
+func cachedResponseBody(size int, gzipped bool) ([]byte, error) {
+	key := responseBodyKey{size: size, gzip: gzipped}
+
+	responseBodies.Lock()
+	body, ok := responseBodies.bodies[key]
+	responseBodies.Unlock()
+	if ok {
+		return body, nil
+	}
+
+	body = responseBody(size)
+	if gzipped {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		if _, err := gz.Write(body); err != nil {
+			return nil, err
+		}
+		if err := gz.Close(); err != nil {
+			return nil, err
+		}
+		body = buf.Bytes()
+	}
+
+	responseBodies.Lock()
+	defer responseBodies.Unlock()
+	if _, ok := responseBodies.bodies[key]; !ok && responseBodies.bytes+len(body) <= maxCachedResponseBytes {
+		responseBodies.bodies[key] = body
+		responseBodies.bytes += len(body)
+	}
+	return body, nil
+}
+
+// serveResponse serves the synthetic response described by r's
+// query string.
+func serveResponse(w http.ResponseWriter, r *http.Request) {
+	spec, err := parseResponseSpec(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	delay := spec.Delay
+	if spec.Jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(spec.Jitter)))
+	}
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	gzipped := spec.Gzip && acceptsGzip(r)
+	body, err := cachedResponseBody(spec.Size, gzipped)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if spec.Gzip {
+		w.Header().Set("Vary", "Accept-Encoding")
+	}
+	if gzipped {
+		w.Header().Set("Content-Encoding", "gzip")
+	}
+
+	if spec.Chunks == 0 {
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.WriteHeader(spec.ExpectedStatus())
+		w.Write(body)
+		return
+	}
+
+	w.WriteHeader(spec.ExpectedStatus())
+	flusher, _ := w.(http.Flusher)
+	chunkSize := (len(body) + spec.Chunks - 1) / spec.Chunks
+	for i := 0; i < spec.Chunks; i++ {
+		if i > 0 && spec.ChunkDelay > 0 {
+			select {
+			case <-time.After(spec.ChunkDelay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		start := i * chunkSize
+		end := start + chunkSize
+		if start > len(body) {
+			start = len(body)
+		}
+		if end > len(body) {
+			end = len(body)
+		}
+		if _, err := w.Write(body[start:end]); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, v := range r.Header.Values("Accept-Encoding") {
+		for _, coding := range strings.Split(v, ",") {
+			coding, params, _ := strings.Cut(strings.TrimSpace(coding), ";")
+			if strings.EqualFold(strings.TrimSpace(coding), "gzip") && strings.ReplaceAll(params, " ", "") != "q=0" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// staticResponse is the embedded page backends have always served,
+// and what request files ask for by default.
+const staticResponse = "static"
+
+// responseCatalogue names the synthetic responses request files can
+// be generated with.
+var responseCatalogue = map[string]ResponseSpec{
+	"small":       {Size: 128},
+	"large":       {Size: 1 << 20},
+	"delayed":     {Size: 1024, Delay: 10 * time.Millisecond},
+	"jittered":    {Size: 1024, Jitter: 50 * time.Millisecond},
+	"chunked":     {Size: 64 << 10, Chunks: 16},
+	"streamed":    {Size: 16 << 10, Chunks: 8, ChunkDelay: 25 * time.Millisecond},
+	"gzip":        {Size: 64 << 10, Gzip: true},
+	"not-found":   {Size: 128, Status: http.StatusNotFound},
+	"unavailable": {Size: 128, Status: http.StatusServiceUnavailable},
+}
+
+// responseNames returns the names in the catalogue, including
+// staticResponse, in order.
+func responseNames() []string {
+	names := []string{staticResponse}
+	for name := range responseCatalogue {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// responsePath returns the path to request for a response named in
+// the catalogue or, failing that, given as a query string in the
+// form ResponseSpec.Path uses (e.g. "size=4096&delay=5ms").
+func responsePath(response string) (string, error) {
+	if response == staticResponse {
+		return "/1024.html", nil
+	}
+	if spec, ok := responseCatalogue[response]; ok {
+		return spec.Path(), nil
+	}
+	if !strings.Contains(response, "=") {
+		return "", fmt.Errorf("unknown response %q; expected one of %s or a query string", response, strings.Join(responseNames(), ", "))
+	}
+	q, err := url.ParseQuery(response)
+	if err != nil {
+		return "", fmt.Errorf("response %q: %v", response, err)
+	}
+	spec, err := parseResponseSpec(q)
+	if err != nil {
+		return "", fmt.Errorf("response %q: %v", response, err)
+	}
+	return spec.Path(), nil
+}
+
+// expectedStatus returns the status code a request for path should
+// receive.
+func expectedStatus(path string) int {
+	u, err := url.Parse(path)
+	if err != nil || u.Path != ResponsePath {
+		return http.StatusOK
+	}
+	spec, err := parseResponseSpec(u.Query())
+	if err != nil {
+		return http.StatusBadRequest
+	}
+	return spec.ExpectedStatus()
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestResponseSpecPath(t *testing.T) {
+	for _, name := range responseNames() {
+		if name == staticResponse {
+			continue
+		}
+		spec := responseCatalogue[name]
+		u, err := url.Parse(spec.Path())
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := parseResponseSpec(u.Query())
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, spec) {
+			t.Errorf("%s: expected %+v, got %+v", name, spec, got)
+		}
+	}
+
+	for _, response := range []string{"nonesuch", "size=-1", "status=99", "status=204", "status=304", "delay=soon", "gzip=maybe"} {
+		if _, err := responsePath(response); err == nil {
+			t.Errorf("%s: expected an error", response)
+		}
+	}
+}
+
+func TestServeResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(serveResponse))
+	defer server.Close()
+
+	for _, tc := range []struct {
+		spec    ResponseSpec
+		chunked bool
+		gzip    bool
+	}{
+		{spec: ResponseSpec{Size: 0}},
+		{spec: ResponseSpec{Size: 3000}},
+		{spec: ResponseSpec{Size: 3000, Status: http.StatusNotFound}},
+		{spec: ResponseSpec{Size: 3000, Chunks: 7, ChunkDelay: time.Millisecond}, chunked: true},
+		{spec: ResponseSpec{Size: 3000, Gzip: true}, gzip: true},
+		{spec: ResponseSpec{Size: 3000, Delay: 10 * time.Millisecond}},
+	} {
+		path := tc.spec.Path()
+
+		start := time.Now()
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.StatusCode != tc.spec.ExpectedStatus() || resp.StatusCode != expectedStatus(path) {
+			t.Errorf("%s: expected status %v, got %v", path, tc.spec.ExpectedStatus(), resp.StatusCode)
+		}
+		if len(body) != tc.spec.Size {
+			t.Errorf("%s: expected %v bytes, got %v", path, tc.spec.Size, len(body))
+		}
+		if chunked := len(resp.TransferEncoding) > 0 && resp.TransferEncoding[0] == "chunked"; chunked != tc.chunked {
+			t.Errorf("%s: expected chunked %v, got %v", path, tc.chunked, resp.TransferEncoding)
+		}
+		// The transport decompresses, and removes the header from,
+		// responses to the gzip encoding it asked for.
+		if resp.Uncompressed != tc.gzip {
+			t.Errorf("%s: expected gzip %v", path, tc.gzip)
+		}
+		if elapsed := time.Since(start); elapsed < tc.spec.Delay {
+			t.Errorf("%s: responded after %v", path, elapsed)
+		}
+	}
+
+	if status := expectedStatus("/1024.html"); status != http.StatusOK {
+		t.Errorf("expected 200 for the static page, got %v", status)
+	}
+}
+
+func TestCachedResponseBody(t *testing.T) {
+	for _, gzipped := range []bool{false, true} {
+		first, err := cachedResponseBody(5000, gzipped)
+		if err != nil {
+			t.Fatal(err)
+		}
+		second, err := cachedResponseBody(5000, gzipped)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if &first[0] != &second[0] {
+			t.Errorf("gzip=%v: expected the body to be built once", gzipped)
+		}
+	}
+}
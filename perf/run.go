@@ -0,0 +1,519 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// specDuration is a time.Duration that is written as a string (e.g.,
+// "60s") in a BenchmarkSpec.
+type specDuration time.Duration
+
+func (d *specDuration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = specDuration(v)
+	return nil
+}
+
+func (d specDuration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d specDuration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// BenchmarkSpec describes a complete benchmark run. Any field that
+// is omitted from the spec file keeps its default value.
+type BenchmarkSpec struct {
+	// Clients is the set of client counts to test each traffic
+	// type with.
+	Clients []int `json:"clients"`
+
+	// Duration of each sample.
+	Duration specDuration `json:"duration"`
+
+	// GatherMetadata enables writing Metadata to
+	// RESULTS/<date>/<host>/.metadata.
+	GatherMetadata bool `json:"gather_metadata"`
+
+	// KeepAliveRequests selects which request files are used.
+	KeepAliveRequests int `json:"keep_alive_requests"`
+
+	// MB is the path to https://github.com/jmencak/mb. If empty
+	// the built-in test client is used.
+	MB string `json:"mb"`
+
+	// Metadata maps a file name in the .metadata directory to a
+	// shell command whose output is written to that file.
+	Metadata map[string]string `json:"metadata"`
+
+	// ProxyBinary is the binary ServeProxy runs. If empty it is
+	// looked up by the proxy's name.
+	ProxyBinary string `json:"proxy_binary"`
+
+	// ProxyHost names the proxy under test in the results layout.
+	ProxyHost string `json:"proxy_host"`
+
+	// ProxyReadyURL, if set, is polled until it returns 200 OK
+	// before the first sample is taken.
+	ProxyReadyURL string `json:"proxy_ready_url"`
+
+	// Responses are the gen-workload responses to mix in each
+	// request file.
+	Responses []string `json:"responses"`
+
+	// ResultsDir is the top-level results directory.
+	ResultsDir string `json:"results_dir"`
+
+	// Samples is the number of samples taken per traffic type.
+	Samples int `json:"samples"`
+
+	// ServeBackends starts the backends and the metadata server
+	// as part of the run. If false, DiscoveryURL must point at
+	// an existing metadata server.
+	ServeBackends bool `json:"serve_backends"`
+
+	// ServeProxy ("haproxy" or "envoy") starts the proxy under
+	// test as part of the run, writing its output to
+	// RESULTS/<date>/<host>/<proxy>.log. If empty the proxy is
+	// expected to be running already.
+	ServeProxy string `json:"serve_proxy"`
+
+	// TimeWaitThreshold is the number of sockets in TIME_WAIT
+	// that must drain before each sample is taken.
+	TimeWaitThreshold int `json:"time_wait_threshold"`
+
+	// TrafficTypes are the request file traffic names (edge,
+	// http, mix, passthrough, reencrypt) to run.
+	TrafficTypes []string `json:"traffic_types"`
+
+	// Workload is the gen-workload subdirectory to take request
+	// files from.
+	Workload string `json:"workload"`
+}
+
+func defaultBenchmarkSpec() BenchmarkSpec {
+	return BenchmarkSpec{
+		Clients:           []int{100},
+		Duration:          specDuration(60 * time.Second),
+		GatherMetadata:    true,
+		KeepAliveRequests: 0,
+		ProxyHost:         mustResolveHostname(),
+		Responses:         []string{staticResponse},
+		ResultsDir:        "RESULTS",
+		Samples:           8,
+		ServeBackends:     true,
+		TimeWaitThreshold: 100,
+		TrafficTypes:      []string{"edge", "http", "reencrypt", "passthrough"},
+		Workload:          "haproxy",
+	}
+}
+
+func loadBenchmarkSpec(filename string) (*BenchmarkSpec, error) {
+	spec := defaultBenchmarkSpec()
+	if filename == "" {
+		return &spec, nil
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&spec); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	if spec.Samples < 1 {
+		return nil, fmt.Errorf("%s: samples must be at least 1", filename)
+	}
+	switch spec.ServeProxy {
+	case "", "haproxy", "envoy":
+	default:
+		return nil, fmt.Errorf("%s: serve_proxy must be haproxy or envoy, not %q", filename, spec.ServeProxy)
+	}
+	return &spec, nil
+}
+
+// countTimeWait returns the number of TCP sockets in TIME_WAIT.
+func countTimeWait() (int, error) {
+	const tcpTimeWait = "06"
+
+	n := 0
+	for _, filename := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		f, err := os.Open(filename)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return 0, err
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Scan() // header
+		for scanner.Scan() {
+			if fields := strings.Fields(scanner.Text()); len(fields) > 3 && fields[3] == tcpTimeWait {
+				n += 1
+			}
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+func waitForTimeWait(ctx context.Context, threshold int) error {
+	for {
+		n, err := countTimeWait()
+		if err != nil {
+			return err
+		}
+		if n <= threshold {
+			return nil
+		}
+		log.Printf("waiting for %d TIME_WAIT connection(s) to drain below %d", n, threshold)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// waitFor calls ready every 250ms until it returns nil, ctx is done
+// or timeout expires.
+func waitFor(ctx context.Context, timeout time.Duration, what string, ready func() error) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		err := ready()
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timeout waiting for %s: %w", what, err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(250 * time.Millisecond):
+		}
+	}
+}
+
+func (c *RunCmd) gatherMetadata(p *ProgramCtx, spec *BenchmarkSpec, metadataDir string) error {
+	data, err := json.MarshalIndent(spec, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := createFile(path.Join(metadataDir, "spec.json"), data); err != nil {
+		return err
+	}
+
+	if haproxyConfig, err := os.ReadFile(path.Join(p.OutputDir, "haproxy", "haproxy.cfg")); err == nil {
+		if err := createFile(path.Join(metadataDir, "haproxy.cfg"), haproxyConfig); err != nil {
+			return err
+		}
+	}
+
+	commands := map[string]string{}
+	if spec.MB != "" {
+		commands["mb"] = fmt.Sprintf("%s version --version", spec.MB)
+	}
+	switch spec.ServeProxy {
+	case "haproxy":
+		commands["haproxy"] = fmt.Sprintf("%s -vv", c.proxyBinary(spec))
+	case "envoy":
+		commands["envoy"] = fmt.Sprintf("%s --version", c.proxyBinary(spec))
+	}
+	for name, command := range spec.Metadata {
+		commands[name] = command
+	}
+
+	for name, command := range commands {
+		output, err := exec.CommandContext(p.Context, "sh", "-c", command).Output()
+		if err != nil {
+			log.Printf("metadata %q: %v", command, err)
+		}
+		if err := createFile(path.Join(metadataDir, name), output); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// requestFile returns the gen-workload request file for traffic type
+// t and the given number of clients.
+func (c *RunCmd) requestFile(p *ProgramCtx, spec *BenchmarkSpec, t string, clients int) (string, error) {
+	pattern := path.Join(p.OutputDir, "requests", spec.Workload,
+		fmt.Sprintf("traffic-%v-backends-*-clients-%v-keepalives-%v.json", t, clients, spec.KeepAliveRequests))
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return "", err
+	}
+	if len(matches) != 1 {
+		return "", fmt.Errorf("expected one request file matching %s, found %d", pattern, len(matches))
+	}
+	return matches[0], nil
+}
+
+func (c *RunCmd) proxyBinary(spec *BenchmarkSpec) string {
+	if spec.ProxyBinary != "" {
+		return spec.ProxyBinary
+	}
+	return spec.ServeProxy
+}
+
+// serveProxy starts the proxy named by spec.ServeProxy, with the
+// configuration for the current topology, and waits for it to
+// serve. The proxy stops when p.Context is done, after which done
+// receives the result.
+func (c *RunCmd) serveProxy(p *ProgramCtx, spec *BenchmarkSpec, logFile string, done chan<- error) error {
+	// The topology is fixed for the duration of a run.
+	const reloadTimeout = 60 * time.Second
+
+	var serve func(*ProgramCtx, chan struct{}) error
+
+	switch spec.ServeProxy {
+	case "haproxy":
+		proxy := c.Proxy
+		proxy.Watch = false
+		cmd := &ServeHAProxyCmd{
+			HAProxy:       c.proxyBinary(spec),
+			LogFile:       logFile,
+			ReloadTimeout: reloadTimeout,
+			Proxy:         proxy,
+		}
+		serve = cmd.serve
+	case "envoy":
+		cmd := &ServeEnvoyCmd{
+			Envoy:         c.proxyBinary(spec),
+			LogFile:       logFile,
+			ReloadTimeout: reloadTimeout,
+			Proxy:         c.Envoy,
+		}
+		serve = cmd.serve
+	}
+
+	ready := make(chan struct{})
+	served := make(chan error, 1)
+
+	go func() {
+		served <- serve(p, ready)
+	}()
+
+	select {
+	case <-ready:
+		go func() {
+			done <- <-served
+		}()
+		return nil
+	case err := <-served:
+		if err == nil {
+			err = p.Context.Err()
+		}
+		return fmt.Errorf("serving %s: %w", spec.ServeProxy, err)
+	}
+}
+
+func (c *RunCmd) runSample(p *ProgramCtx, spec *BenchmarkSpec, requestFile, stdoutPath, stderrPath string) error {
+	stdout, err := os.Create(stdoutPath)
+	if err != nil {
+		return err
+	}
+	defer stdout.Close()
+
+	stderr, err := os.Create(stderrPath)
+	if err != nil {
+		return err
+	}
+	defer stderr.Close()
+
+	if spec.MB != "" {
+		cmd := exec.CommandContext(p.Context, spec.MB,
+			"--duration", fmt.Sprint(int(time.Duration(spec.Duration).Seconds())),
+			"--request-file", requestFile)
+		cmd.Stdout = stdout
+		cmd.Stderr = stderr
+		return cmd.Run()
+	}
+
+	test := TestCmd{
+		Arrival:     "constant",
+		Duration:    time.Duration(spec.Duration),
+		RequestFile: requestFile,
+	}
+
+	logger := log.Writer()
+	log.SetOutput(io.MultiWriter(logger, stderr))
+	defer log.SetOutput(logger)
+
+	return test.run(p, stdout)
+}
+
+func (c *RunCmd) Run(p *ProgramCtx) error {
+	spec, err := loadBenchmarkSpec(c.Spec)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(p.Context)
+	defer cancel()
+
+	runCtx := &ProgramCtx{Globals: p.Globals, Context: ctx}
+
+	backendsDone := make(chan error, 1)
+
+	if spec.ServeBackends {
+		go func() {
+			backendsDone <- c.Backends.Run(runCtx)
+		}()
+		if err := waitFor(ctx, 60*time.Second, "backends", func() error {
+			select {
+			case err := <-backendsDone:
+				return fmt.Errorf("serve-backends exited: %v", err)
+			default:
+			}
+			_, err := fetchAllBackendMetadata(p.DiscoveryURL)
+			return err
+		}); err != nil {
+			return err
+		}
+	}
+
+	date := time.Now().Format("20060102-150405")
+	hostResultsDir := path.Join(spec.ResultsDir, date, spec.ProxyHost)
+
+	if spec.ServeProxy != "" {
+		proxyDone := make(chan error, 1)
+		logFile := path.Join(hostResultsDir, spec.ServeProxy+".log")
+		if err := c.serveProxy(runCtx, spec, logFile, proxyDone); err != nil {
+			return err
+		}
+		// Stop the proxy however the run ends.
+		defer func() {
+			cancel()
+			if err := <-proxyDone; err != nil {
+				log.Printf("%s: %v", spec.ServeProxy, err)
+			}
+		}()
+	} else {
+		// The topology is fixed for the duration of a run.
+		proxy := c.Proxy
+		proxy.Watch = false
+
+		if err := proxy.Run(runCtx); err != nil {
+			return err
+		}
+	}
+
+	workload := GenWorkloadCmd{
+		Clients:           spec.Clients,
+		KeepAliveRequests: []int{spec.KeepAliveRequests},
+		Responses:         spec.Responses,
+		UseProxy:          true,
+	}
+	if err := workload.Run(runCtx); err != nil {
+		return err
+	}
+
+	if spec.ProxyReadyURL != "" {
+		if err := waitFor(ctx, 60*time.Second, spec.ProxyReadyURL, func() error {
+			resp, err := http.Get(spec.ProxyReadyURL)
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				return fmt.Errorf("%s: %v", spec.ProxyReadyURL, resp.Status)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+
+	if spec.GatherMetadata {
+		if err := c.gatherMetadata(runCtx, spec, path.Join(hostResultsDir, ".metadata")); err != nil {
+			return err
+		}
+	}
+
+	for _, t := range spec.TrafficTypes {
+		for _, clients := range spec.Clients {
+			requestFile, err := c.requestFile(p, spec, t, clients)
+			if err != nil {
+				return err
+			}
+
+			testName := t
+			if len(spec.Clients) > 1 {
+				testName = fmt.Sprintf("%s-clients-%d", t, clients)
+			}
+
+			testOutputDir := path.Join(hostResultsDir, testName)
+			if err := os.MkdirAll(testOutputDir, 0755); err != nil {
+				return err
+			}
+
+			for i := 1; i <= spec.Samples; i++ {
+				if err := waitForTimeWait(ctx, spec.TimeWaitThreshold); err != nil {
+					return err
+				}
+				log.Printf("%d/%d %s %s", i, spec.Samples, testOutputDir, requestFile)
+				basename := path.Join(testOutputDir, fmt.Sprintf("%d-%s-%s", i, testName, spec.ProxyHost))
+				if err := c.runSample(runCtx, spec, requestFile, basename+".stdout", basename+".stderr"); err != nil {
+					return fmt.Errorf("%s: %w", basename, err)
+				}
+			}
+
+			if err := filepath.Walk(testOutputDir, func(filename string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				return os.Chmod(filename, info.Mode()&^0220)
+			}); err != nil {
+				return err
+			}
+		}
+	}
+
+	latest := path.Join(spec.ResultsDir, "latest")
+	if err := os.Remove(latest); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Symlink(date, latest); err != nil {
+		return err
+	}
+
+	log.Printf("results written to %s", hostResultsDir)
+
+	if spec.ServeBackends {
+		cancel()
+		if err := <-backendsDone; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// studentT975 holds the two-sided 95% critical values of Student's t
+// distribution for 1 to 30 degrees of freedom.
+var studentT975 = [...]float64{
+	12.706, 4.303, 3.182, 2.776, 2.571, 2.447, 2.365, 2.306, 2.262, 2.228,
+	2.201, 2.179, 2.160, 2.145, 2.131, 2.120, 2.110, 2.101, 2.093, 2.086,
+	2.080, 2.074, 2.069, 2.064, 2.060, 2.056, 2.052, 2.048, 2.045, 2.042,
+}
+
+// SampleStats summarises a set of samples.
+type SampleStats struct {
+	N        int     `json:"n"`
+	Mean     float64 `json:"mean"`
+	Median   float64 `json:"median"`
+	Stddev   float64 `json:"stddev"`
+	Min      float64 `json:"min"`
+	Max      float64 `json:"max"`
+	CI95Low  float64 `json:"ci95_low"`
+	CI95High float64 `json:"ci95_high"`
+}
+
+func mean(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sum := 0.0
+	for _, v := range values {
+		sum += v
+	}
+	return sum / float64(len(values))
+}
+
+func median(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+// stddev returns the sample standard deviation.
+func stddev(values []float64) float64 {
+	if len(values) < 2 {
+		return 0
+	}
+	m := mean(values)
+	sum := 0.0
+	for _, v := range values {
+		sum += (v - m) * (v - m)
+	}
+	return math.Sqrt(sum / float64(len(values)-1))
+}
+
+func tCritical95(degreesOfFreedom int) float64 {
+	if degreesOfFreedom < 1 {
+		return math.Inf(1)
+	}
+	if degreesOfFreedom <= len(studentT975) {
+		return studentT975[degreesOfFreedom-1]
+	}
+	return 1.96
+}
+
+func computeSampleStats(values []float64) SampleStats {
+	stats := SampleStats{
+		N:      len(values),
+		Mean:   mean(values),
+		Median: median(values),
+		Stddev: stddev(values),
+	}
+	if len(values) == 0 {
+		return stats
+	}
+	stats.Min, stats.Max = values[0], values[0]
+	for _, v := range values {
+		stats.Min = math.Min(stats.Min, v)
+		stats.Max = math.Max(stats.Max, v)
+	}
+	if len(values) < 2 {
+		stats.CI95Low, stats.CI95High = stats.Mean, stats.Mean
+		return stats
+	}
+	margin := tCritical95(len(values)-1) * stats.Stddev / math.Sqrt(float64(len(values)))
+	stats.CI95Low = stats.Mean - margin
+	stats.CI95High = stats.Mean + margin
+	return stats
+}
+
+// ranks returns the rank of each value in the concatenation of x
+// and y, with ties given their average rank, and the tie correction
+// term sum(t^3 - t) over each group of t tied values.
+func ranks(x, y []float64) ([]float64, float64) {
+	type ranked struct {
+		value float64
+		index int
+	}
+
+	all := make([]ranked, 0, len(x)+len(y))
+	for i, v := range x {
+		all = append(all, ranked{v, i})
+	}
+	for i, v := range y {
+		all = append(all, ranked{v, len(x) + i})
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].value < all[j].value })
+
+	result := make([]float64, len(all))
+	tieCorrection := 0.0
+
+	for i := 0; i < len(all); {
+		j := i + 1
+		for j < len(all) && all[j].value == all[i].value {
+			j++
+		}
+		rank := float64(i+j+1) / 2
+		for k := i; k < j; k++ {
+			result[all[k].index] = rank
+		}
+		if t := float64(j - i); t > 1 {
+			tieCorrection += t*t*t - t
+		}
+		i = j
+	}
+
+	return result, tieCorrection
+}
+
+// mannWhitneyUDistribution returns the number of arrangements of m
+// and n samples that produce each value of U, for U from 0 to m*n.
+func mannWhitneyUDistribution(m, n int) []float64 {
+	// counts[i][j][u] is built up one sample at a time; only the
+	// previous row is kept.
+	prev := make([][]float64, n+1)
+	for j := range prev {
+		prev[j] = []float64{1}
+	}
+	for i := 1; i <= m; i++ {
+		cur := make([][]float64, n+1)
+		cur[0] = []float64{1}
+		for j := 1; j <= n; j++ {
+			cur[j] = make([]float64, i*j+1)
+			// The largest sample is either from x, in
+			// which case it beats all j samples of y,
+			// or from y, in which case it beats none.
+			for u, c := range prev[j] {
+				cur[j][u+j] += c
+			}
+			for u, c := range cur[j-1] {
+				cur[j][u] += c
+			}
+		}
+		prev = cur
+	}
+	return prev[n]
+}
+
+// mannWhitneyU performs a two-sided Mann-Whitney U test and returns
+// the U statistic for x and the p-value. Small samples without ties
+// use the exact distribution of U; otherwise the normal
+// approximation with tie and continuity corrections is used.
+func mannWhitneyU(x, y []float64) (float64, float64) {
+	n1, n2 := float64(len(x)), float64(len(y))
+	if n1 == 0 || n2 == 0 {
+		return 0, 1
+	}
+
+	r, tieCorrection := ranks(x, y)
+	rankSum := 0.0
+	for i := range x {
+		rankSum += r[i]
+	}
+	u := rankSum - n1*(n1+1)/2
+
+	if tieCorrection == 0 && len(x)+len(y) <= 40 {
+		dist := mannWhitneyUDistribution(len(x), len(y))
+		total, lower, upper := 0.0, 0.0, 0.0
+		for k, c := range dist {
+			total += c
+			if float64(k) <= u {
+				lower += c
+			}
+			if float64(k) >= u {
+				upper += c
+			}
+		}
+		return u, math.Min(1, 2*math.Min(lower, upper)/total)
+	}
+
+	n := n1 + n2
+	mu := n1 * n2 / 2
+	sigma := math.Sqrt(n1 * n2 / 12 * ((n + 1) - tieCorrection/(n*(n-1))))
+	if sigma == 0 {
+		return u, 1
+	}
+	z := (math.Abs(u-mu) - 0.5) / sigma
+	if z < 0 {
+		z = 0
+	}
+	return u, math.Min(1, math.Erfc(z/math.Sqrt2))
+}
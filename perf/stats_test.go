@@ -0,0 +1,30 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestMannWhitneyU(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		x, y []float64
+		u, p float64
+	}{
+		{"separated", []float64{1, 2, 3, 4, 5}, []float64{6, 7, 8, 9, 10}, 0, 2.0 / 252},
+		{"reversed", []float64{6, 7, 8, 9, 10}, []float64{1, 2, 3, 4, 5}, 25, 2.0 / 252},
+		{"interleaved", []float64{1, 3, 5, 7, 9}, []float64{2, 4, 6, 8, 10}, 10, 0.690},
+		{"identical", []float64{1, 1, 1}, []float64{1, 1, 1}, 4.5, 1},
+		{"ties", []float64{1, 2, 2, 3, 3, 3}, []float64{3, 4, 4, 5, 5, 6}, 1.5, 0.0087},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			u, p := mannWhitneyU(tc.x, tc.y)
+			if u != tc.u {
+				t.Errorf("expected U=%v, got %v", tc.u, u)
+			}
+			if math.Abs(p-tc.p) > 0.001 {
+				t.Errorf("expected p=%v, got %v", tc.p, p)
+			}
+		})
+	}
+}
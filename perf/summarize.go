@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// resultSample is the outcome of one benchmark sample, parsed from
+// the stdout of mb or of the built-in test client.
+type resultSample struct {
+	Duration         float64 // seconds
+	SentBytesPerSec  float64
+	RecvBytesPerSec  float64
+	Hits             int64
+	RequestsPerSec   float64
+	ConnectionErrors int64
+	StatusErrors     int64
+	ParserErrors     int64
+
+	// Latency percentiles in milliseconds; only the built-in
+	// client reports these.
+	HasLatency bool
+	LatencyP50 float64
+	LatencyP99 float64
+}
+
+var (
+	mbTimeRegexp        = regexp.MustCompile(`^Time: ([\d.]+)s`)
+	mbTransferRegexp    = regexp.MustCompile(`^(Sent|Recv): [\d.]+[KMGT]?i?B, ([\d.]+)([KMGT]?i?B)/s`)
+	mbHitsRegexp        = regexp.MustCompile(`^Hits: (\d+), ([\d.]+)/s`)
+	mbErrorsRegexp      = regexp.MustCompile(`^Errors connection: (\d+), status: (\d+), parser: (\d+)`)
+	builtinHitsRegexp   = regexp.MustCompile(`^hits: (\d+) errors: (\d+) bad_status: (\d+) request/s: ([\d.]+)`)
+	latencyHeaderPrefix = "latency (ms)"
+)
+
+var byteUnits = map[string]float64{
+	"B":   1,
+	"KiB": 1 << 10,
+	"MiB": 1 << 20,
+	"GiB": 1 << 30,
+	"TiB": 1 << 40,
+}
+
+// numberParser converts the numbers matched in a results file,
+// keeping the first error.
+type numberParser struct {
+	err error
+}
+
+func (p *numberParser) setErr(err error) {
+	if p.err == nil {
+		p.err = err
+	}
+}
+
+func (p *numberParser) int64(s string) int64 {
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		p.setErr(err)
+	}
+	return v
+}
+
+func (p *numberParser) float(s string) float64 {
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		p.setErr(err)
+	}
+	return v
+}
+
+func (p *numberParser) bytes(value, unit string) float64 {
+	multiplier, ok := byteUnits[unit]
+	if !ok {
+		p.setErr(fmt.Errorf("unknown unit %q", unit))
+	}
+	return p.float(value) * multiplier
+}
+
+func parseResultSample(r io.Reader) (*resultSample, error) {
+	var (
+		sample        resultSample
+		foundHits     bool
+		latencyHeader []string
+	)
+
+	scanner := bufio.NewScanner(r)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		var number numberParser
+		line := scanner.Text()
+		if m := mbTimeRegexp.FindStringSubmatch(line); m != nil {
+			sample.Duration = number.float(m[1])
+		} else if m := mbTransferRegexp.FindStringSubmatch(line); m != nil {
+			bytesPerSec := number.bytes(m[2], m[3])
+			if m[1] == "Sent" {
+				sample.SentBytesPerSec = bytesPerSec
+			} else {
+				sample.RecvBytesPerSec = bytesPerSec
+			}
+		} else if m := mbHitsRegexp.FindStringSubmatch(line); m != nil {
+			sample.Hits = number.int64(m[1])
+			sample.RequestsPerSec = number.float(m[2])
+			foundHits = true
+		} else if m := mbErrorsRegexp.FindStringSubmatch(line); m != nil {
+			sample.ConnectionErrors = number.int64(m[1])
+			sample.StatusErrors = number.int64(m[2])
+			sample.ParserErrors = number.int64(m[3])
+		} else if m := builtinHitsRegexp.FindStringSubmatch(line); m != nil {
+			sample.Hits = number.int64(m[1])
+			sample.ConnectionErrors = number.int64(m[2])
+			sample.StatusErrors = number.int64(m[3])
+			sample.RequestsPerSec = number.float(m[4])
+			foundHits = true
+		} else if strings.HasPrefix(line, latencyHeaderPrefix) {
+			latencyHeader = strings.Fields(strings.TrimPrefix(line, latencyHeaderPrefix))
+		} else if fields := strings.Fields(line); latencyHeader != nil && len(fields) == len(latencyHeader)+1 && fields[0] == "all" {
+			for i, column := range latencyHeader {
+				switch column {
+				case "p50":
+					sample.LatencyP50 = number.float(fields[i+1])
+				case "p99":
+					sample.LatencyP99 = number.float(fields[i+1])
+				}
+			}
+			sample.HasLatency = true
+		}
+		if number.err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineno, number.err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if !foundHits {
+		return nil, fmt.Errorf("no hits reported")
+	}
+	return &sample, nil
+}
+
+// resultSet is every sample for one host and traffic type in a
+// results directory (RESULTS/<date>/<host>/<traffic-type>).
+type resultSet struct {
+	Results     string
+	Host        string
+	TrafficType string
+	Samples     []*resultSample
+}
+
+// loadResults parses all samples below a RESULTS/<date> directory.
+func loadResults(dir string) ([]*resultSet, error) {
+	filenames, err := filepath.Glob(filepath.Join(dir, "*", "*", "*.stdout"))
+	if err != nil {
+		return nil, err
+	}
+	if len(filenames) == 0 {
+		return nil, fmt.Errorf("%s: no results found", dir)
+	}
+	sort.Strings(filenames)
+
+	results := filepath.Base(dir)
+	if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+		results = filepath.Base(resolved)
+	}
+
+	var sets []*resultSet
+	byKey := map[string]*resultSet{}
+
+	for _, filename := range filenames {
+		trafficDir := filepath.Dir(filename)
+		host := filepath.Base(filepath.Dir(trafficDir))
+		trafficType := filepath.Base(trafficDir)
+
+		f, err := os.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+		sample, err := parseResultSample(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filename, err)
+		}
+
+		key := host + "/" + trafficType
+		set, ok := byKey[key]
+		if !ok {
+			set = &resultSet{Results: results, Host: host, TrafficType: trafficType}
+			byKey[key] = set
+			sets = append(sets, set)
+		}
+		set.Samples = append(set.Samples, sample)
+	}
+
+	return sets, nil
+}
+
+func (s *resultSet) requestsPerSec() []float64 {
+	var values []float64
+	for _, sample := range s.Samples {
+		values = append(values, sample.RequestsPerSec)
+	}
+	return values
+}
+
+func (s *resultSet) recvMiBPerSec() []float64 {
+	var values []float64
+	for _, sample := range s.Samples {
+		values = append(values, sample.RecvBytesPerSec/(1<<20))
+	}
+	return values
+}
+
+func (s *resultSet) latencies(p99 bool) []float64 {
+	var values []float64
+	for _, sample := range s.Samples {
+		if !sample.HasLatency {
+			continue
+		}
+		if p99 {
+			values = append(values, sample.LatencyP99)
+		} else {
+			values = append(values, sample.LatencyP50)
+		}
+	}
+	return values
+}
+
+// ResultSummary is the statistical summary of a resultSet.
+type ResultSummary struct {
+	Results          string       `json:"results"`
+	Host             string       `json:"host"`
+	TrafficType      string       `json:"traffic_type"`
+	Samples          int          `json:"samples"`
+	Hits             int64        `json:"hits"`
+	ConnectionErrors int64        `json:"connection_errors"`
+	StatusErrors     int64        `json:"status_errors"`
+	RequestsPerSec   SampleStats  `json:"requests_per_sec"`
+	RecvMiBPerSec    SampleStats  `json:"recv_mib_per_sec"`
+	LatencyP50       *SampleStats `json:"latency_p50_ms,omitempty"`
+	LatencyP99       *SampleStats `json:"latency_p99_ms,omitempty"`
+}
+
+func summarizeResultSet(s *resultSet) ResultSummary {
+	summary := ResultSummary{
+		Results:        s.Results,
+		Host:           s.Host,
+		TrafficType:    s.TrafficType,
+		Samples:        len(s.Samples),
+		RequestsPerSec: computeSampleStats(s.requestsPerSec()),
+		RecvMiBPerSec:  computeSampleStats(s.recvMiBPerSec()),
+	}
+	for _, sample := range s.Samples {
+		summary.Hits += sample.Hits
+		summary.ConnectionErrors += sample.ConnectionErrors
+		summary.StatusErrors += sample.StatusErrors + sample.ParserErrors
+	}
+	if p50 := s.latencies(false); len(p50) > 0 {
+		stats := computeSampleStats(p50)
+		summary.LatencyP50 = &stats
+	}
+	if p99 := s.latencies(true); len(p99) > 0 {
+		stats := computeSampleStats(p99)
+		summary.LatencyP99 = &stats
+	}
+	return summary
+}
+
+func formatLatencyStats(stats *SampleStats) string {
+	if stats == nil {
+		return "-"
+	}
+	return fmt.Sprintf("%.3f", stats.Mean)
+}
+
+func writeSummaryTable(w io.Writer, summaries []ResultSummary) error {
+	var tw *tabwriter.Writer
+
+	for i, s := range summaries {
+		if i == 0 || s.Results != summaries[i-1].Results || s.Host != summaries[i-1].Host {
+			if tw != nil {
+				if err := tw.Flush(); err != nil {
+					return err
+				}
+				if _, err := fmt.Fprintln(w); err != nil {
+					return err
+				}
+			}
+			if _, err := fmt.Fprintf(w, "%s / %d samples / %s\n", s.Results, s.Samples, s.Host); err != nil {
+				return err
+			}
+			tw = tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+			if _, err := fmt.Fprintln(tw, "traffic\tsamples\thits (sum)\tconn errors (sum)\tstatus errors (sum)\trequests/s (mean)\tmedian\tstddev\tmin\tmax\t95% CI\trecv MiB/s (mean)\tp50 ms (mean)\tp99 ms (mean)"); err != nil {
+				return err
+			}
+		}
+		rps := s.RequestsPerSec
+		if _, err := fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%.0f\t%.0f\t%.0f\t%.0f\t%.0f\t%.0f-%.0f\t%.2f\t%s\t%s\n",
+			s.TrafficType, s.Samples, s.Hits, s.ConnectionErrors, s.StatusErrors,
+			rps.Mean, rps.Median, rps.Stddev, rps.Min, rps.Max, rps.CI95Low, rps.CI95High, s.RecvMiBPerSec.Mean,
+			formatLatencyStats(s.LatencyP50), formatLatencyStats(s.LatencyP99)); err != nil {
+			return err
+		}
+	}
+
+	if tw != nil {
+		return tw.Flush()
+	}
+	return nil
+}
+
+func writeSummaryCSV(w io.Writer, summaries []ResultSummary) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{
+		"results", "host", "traffic_type", "samples", "hits", "connection_errors", "status_errors",
+		"rps_mean", "rps_median", "rps_stddev", "rps_min", "rps_max", "rps_ci95_low", "rps_ci95_high",
+		"recv_mib_per_sec_mean", "latency_p50_ms_mean", "latency_p99_ms_mean",
+	}); err != nil {
+		return err
+	}
+	f := func(v float64) string { return strconv.FormatFloat(v, 'f', 3, 64) }
+	optional := func(stats *SampleStats) string {
+		if stats == nil {
+			return ""
+		}
+		return f(stats.Mean)
+	}
+	for _, s := range summaries {
+		rps := s.RequestsPerSec
+		if err := cw.Write([]string{
+			s.Results, s.Host, s.TrafficType, strconv.Itoa(s.Samples),
+			strconv.FormatInt(s.Hits, 10), strconv.FormatInt(s.ConnectionErrors, 10), strconv.FormatInt(s.StatusErrors, 10),
+			f(rps.Mean), f(rps.Median), f(rps.Stddev), f(rps.Min), f(rps.Max), f(rps.CI95Low), f(rps.CI95High),
+			f(s.RecvMiBPerSec.Mean), optional(s.LatencyP50), optional(s.LatencyP99),
+		}); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func (c *SummarizeCmd) Run(p *ProgramCtx) error {
+	var summaries []ResultSummary
+
+	for _, dir := range c.Dirs {
+		sets, err := loadResults(dir)
+		if err != nil {
+			return err
+		}
+		for _, set := range sets {
+			summaries = append(summaries, summarizeResultSet(set))
+		}
+	}
+
+	switch c.Format {
+	case "json":
+		data, err := json.MarshalIndent(summaries, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Println(string(data))
+		return err
+	case "csv":
+		return writeSummaryCSV(os.Stdout, summaries)
+	default:
+		return writeSummaryTable(os.Stdout, summaries)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestComputeSampleStats(t *testing.T) {
+	stats := computeSampleStats([]float64{2, 4, 4, 4, 5, 5, 7, 9})
+
+	for _, tc := range []struct {
+		name     string
+		got      float64
+		expected float64
+	}{
+		{"mean", stats.Mean, 5},
+		{"median", stats.Median, 4.5},
+		{"stddev", stats.Stddev, 2.138},
+		{"min", stats.Min, 2},
+		{"max", stats.Max, 9},
+		{"ci95_low", stats.CI95Low, 3.212},
+		{"ci95_high", stats.CI95High, 6.788},
+	} {
+		if math.Abs(tc.got-tc.expected) > 0.001 {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.expected, tc.got)
+		}
+	}
+}
+
+func TestParseResultSample(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		input  string
+		sample resultSample
+	}{{
+		name: "mb",
+		input: `Time: 60.09s
+Sent: 188.19MiB, 3.13MiB/s
+Recv: 2.13GiB, 36.33MiB/s
+Hits: 1779322, 29609.03/s
+Errors connection: 2282, status: 1, parser: 2
+`,
+		sample: resultSample{
+			Duration:         60.09,
+			SentBytesPerSec:  3.13 * (1 << 20),
+			RecvBytesPerSec:  36.33 * (1 << 20),
+			Hits:             1779322,
+			RequestsPerSec:   29609.03,
+			ConnectionErrors: 2282,
+			StatusErrors:     1,
+			ParserErrors:     2,
+		},
+	}, {
+		name: "built-in",
+		input: `hits: 19173 errors: 3 bad_status: 4 request/s: 19173.00
+latency (ms)            count  p50    p90    p99    p99.9  max
+all                     19173  0.094  0.123  0.519  1.135  4.948
+edge                    19173  0.094  0.123  0.519  1.135  4.948
+`,
+		sample: resultSample{
+			Hits:             19173,
+			RequestsPerSec:   19173,
+			ConnectionErrors: 3,
+			StatusErrors:     4,
+			HasLatency:       true,
+			LatencyP50:       0.094,
+			LatencyP99:       0.519,
+		},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			sample, err := parseResultSample(strings.NewReader(tc.input))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *sample != tc.sample {
+				t.Errorf("expected %+v, got %+v", tc.sample, *sample)
+			}
+		})
+	}
+
+	for _, input := range []string{
+		"Time: 60.09s\n",
+		"Time: 1.2.3s\nHits: 1, 1.00/s\n",
+		"Sent: 188.19MB, 3.13MB/s\nHits: 1, 1.00/s\n",
+		"hits: 1 errors: 0 bad_status: 0 request/s: 1.00\nlatency (ms) count p50\nall 1 0.1.2\n",
+	} {
+		if _, err := parseResultSample(strings.NewReader(input)); err == nil {
+			t.Errorf("%q: expected an error", input)
+		}
+	}
+}
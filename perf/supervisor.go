@@ -0,0 +1,341 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// proxyProcess is a proxy run from the configuration written by its
+// ProxyConfigGenerator.
+type proxyProcess interface {
+	// reload starts the proxy, or has it take up a regenerated
+	// configuration without dropping connections, and waits up
+	// to timeout for it to do so.
+	reload(timeout time.Duration) error
+
+	// stop terminates the proxy and waits for it to exit.
+	stop()
+}
+
+// haproxyMaster runs HAProxy in master-worker mode (-W): reloading
+// signals the master, which rereads the configuration and starts a
+// new worker, and the old worker finishes serving its connections
+// before exiting.
+type haproxyMaster struct {
+	binary string
+	config string
+	socket string
+	log    io.Writer
+
+	cmd    *exec.Cmd
+	exited chan error
+	worker string
+}
+
+// workerPid returns the pid of the worker answering on the stats
+// socket, if it is one of our master's. A stale HAProxy left running
+// on the same socket is not.
+func (h *haproxyMaster) workerPid() string {
+	info, err := haproxyInfo(h.socket)
+	if err != nil {
+		return ""
+	}
+	pid := info["Pid"]
+	if ppid, err := parentPid(pid); err != nil || ppid != h.cmd.Process.Pid {
+		return ""
+	}
+	return pid
+}
+
+// parentPid returns the parent of process pid, from /proc.
+func parentPid(pid string) (int, error) {
+	stat, err := os.ReadFile(path.Join("/proc", pid, "stat"))
+	if err != nil {
+		return 0, err
+	}
+	// The command name, in parentheses, may itself contain
+	// spaces and parentheses; the state and parent pid follow
+	// the last ')'.
+	i := strings.LastIndexByte(string(stat), ')')
+	if i < 0 {
+		return 0, fmt.Errorf("/proc/%s/stat: no command name", pid)
+	}
+	fields := strings.Fields(string(stat[i+1:]))
+	if len(fields) < 2 {
+		return 0, fmt.Errorf("/proc/%s/stat: no parent pid", pid)
+	}
+	return strconv.Atoi(fields[1])
+}
+
+func (h *haproxyMaster) reload(timeout time.Duration) error {
+	if h.cmd == nil {
+		cmd := exec.Command(h.binary, "-W", "-f", h.config)
+		cmd.Stdout = h.log
+		cmd.Stderr = h.log
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Pdeathsig: syscall.SIGTERM,
+		}
+		if err := cmd.Start(); err != nil {
+			return err
+		}
+		h.cmd = cmd
+		h.exited = make(chan error, 1)
+		go func() {
+			h.exited <- cmd.Wait()
+		}()
+	} else if err := h.cmd.Process.Signal(syscall.SIGUSR2); err != nil {
+		return err
+	}
+
+	deadline := time.After(timeout)
+
+	for {
+		if pid := h.workerPid(); pid != "" && pid != h.worker {
+			h.worker = pid
+			return nil
+		}
+		select {
+		case err := <-h.exited:
+			h.exited <- err
+			return fmt.Errorf("%s exited: %v", h.binary, err)
+		case <-deadline:
+			// The master keeps the previous worker if the
+			// new configuration is bad.
+			return fmt.Errorf("%s: no new worker within %v", h.binary, timeout)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func (h *haproxyMaster) stop() {
+	if h.cmd == nil {
+		return
+	}
+	// The master stops its workers before exiting.
+	_ = h.cmd.Process.Signal(syscall.SIGTERM)
+	select {
+	case <-h.exited:
+	case <-time.After(proxyStopTimeout):
+		log.Printf("%s did not exit within %v; killing it", h.binary, proxyStopTimeout)
+		_ = h.cmd.Process.Kill()
+		<-h.exited
+	}
+	h.cmd = nil
+}
+
+// envoyProcesses runs Envoy and reloads it with a hot restart: each
+// reload starts a new process with the next restart epoch, which
+// takes the listening sockets from the current one, and drains and
+// then shuts down the old process.
+type envoyProcesses struct {
+	proxyProcesses
+
+	config    string
+	adminURL  string
+	baseID    int
+	drainTime time.Duration
+
+	epoch int
+}
+
+// envoyServerInfo is the part of the admin /server_info response
+// that shows which process is serving.
+type envoyServerInfo struct {
+	State              string `json:"state"`
+	CommandLineOptions struct {
+		RestartEpoch int `json:"restart_epoch"`
+	} `json:"command_line_options"`
+}
+
+func (e *envoyProcesses) serverInfo() (*envoyServerInfo, error) {
+	client := http.Client{Timeout: time.Second}
+	resp, err := client.Get(e.adminURL + "/server_info")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s/server_info: %v", e.adminURL, resp.Status)
+	}
+	var info envoyServerInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+func (e *envoyProcesses) reload(timeout time.Duration) error {
+	_, running := e.state()
+
+	epoch := e.epoch
+	if len(running) > 0 {
+		epoch += 1
+	}
+
+	drainTime := int(e.drainTime.Seconds())
+	args := []string{
+		"-c", e.config,
+		"--base-id", strconv.Itoa(e.baseID),
+		"--restart-epoch", strconv.Itoa(epoch),
+		"--drain-time-s", strconv.Itoa(drainTime),
+		"--parent-shutdown-time-s", strconv.Itoa(drainTime + 1),
+	}
+
+	if err := e.start(args, timeout, func(int) bool {
+		info, err := e.serverInfo()
+		return err == nil && info.State == "LIVE" && info.CommandLineOptions.RestartEpoch == epoch
+	}); err != nil {
+		return err
+	}
+
+	e.epoch = epoch
+	return nil
+}
+
+// proxySupervisor generates a proxy's configuration and runs the
+// proxy with it, reloading it whenever the configuration is
+// regenerated, until the context is done.
+type proxySupervisor struct {
+	generator     ProxyConfigGenerator
+	process       proxyProcess
+	reloadTimeout time.Duration
+	watch         bool
+
+	// ready, if not nil, is closed once the proxy is serving
+	// its first configuration.
+	ready chan struct{}
+}
+
+func (s *proxySupervisor) run(p *ProgramCtx) error {
+	defer s.process.stop()
+
+	started := false
+
+	apply := func(version uint64, backendsByTrafficType BoundBackendsByTrafficType) error {
+		if err := generateProxyConfig(p, s.generator, version, backendsByTrafficType); err != nil {
+			return err
+		}
+		if err := s.process.reload(s.reloadTimeout); err != nil {
+			if !started {
+				return err
+			}
+			// The proxy is still serving the previous
+			// configuration.
+			log.Printf("reloading %s for topology version %v: %v", s.generator.Name(), version, err)
+			return nil
+		}
+		if !started {
+			started = true
+			log.Printf("started %s", s.generator.Name())
+			if s.ready != nil {
+				close(s.ready)
+			}
+			return nil
+		}
+		log.Printf("reloaded %s for topology version %v", s.generator.Name(), version)
+		return nil
+	}
+
+	if s.watch {
+		return watchBackendMetadata(p.Context, p.DiscoveryURL, apply)
+	}
+
+	backendsByTrafficType, err := fetchAllBackendMetadata(p.DiscoveryURL)
+	if err != nil {
+		return err
+	}
+	if err := apply(0, backendsByTrafficType); err != nil {
+		return err
+	}
+
+	<-p.Context.Done()
+	return nil
+}
+
+// openProxyLog opens filename, or OutputDir/<name>.log, for a
+// proxy's output. It is kept outside the proxy's configuration
+// directory, which is recreated on every change.
+func openProxyLog(p *ProgramCtx, filename, name string) (*os.File, error) {
+	if filename == "" {
+		filename = path.Join(p.OutputDir, name+".log")
+	}
+	if err := os.MkdirAll(path.Dir(filename), 0755); err != nil {
+		return nil, err
+	}
+	return os.Create(filename)
+}
+
+func (c *ServeHAProxyCmd) Run(p *ProgramCtx) error {
+	return c.serve(p, nil)
+}
+
+// serve runs HAProxy until p.Context is done, closing ready, if not
+// nil, once it is serving.
+func (c *ServeHAProxyCmd) serve(p *ProgramCtx, ready chan struct{}) error {
+	if c.Proxy.Watch {
+		return errors.New("use --watch, not --proxy-watch, to reload on topology changes")
+	}
+
+	logFile, err := openProxyLog(p, c.LogFile, c.Proxy.Name())
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+
+	supervisor := &proxySupervisor{
+		generator: &c.Proxy,
+		process: &haproxyMaster{
+			binary: c.HAProxy,
+			config: path.Join(p.OutputDir, c.Proxy.Name(), "haproxy.cfg"),
+			socket: haproxyStatsSocket(p),
+			log:    logFile,
+		},
+		reloadTimeout: c.ReloadTimeout,
+		watch:         c.Watch,
+		ready:         ready,
+	}
+	return supervisor.run(p)
+}
+
+func (c *ServeEnvoyCmd) Run(p *ProgramCtx) error {
+	return c.serve(p, nil)
+}
+
+// serve runs Envoy until p.Context is done, closing ready, if not
+// nil, once it is serving.
+func (c *ServeEnvoyCmd) serve(p *ProgramCtx, ready chan struct{}) error {
+	logFile, err := openProxyLog(p, c.LogFile, c.Proxy.Name())
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+
+	supervisor := &proxySupervisor{
+		generator: &c.Proxy,
+		process: &envoyProcesses{
+			proxyProcesses: proxyProcesses{
+				binary: c.Envoy,
+				log:    logFile,
+			},
+			config:    path.Join(p.OutputDir, c.Proxy.Name(), "envoy.json"),
+			adminURL:  fmt.Sprintf("http://%s:%d", c.Proxy.ListenAddress, c.Proxy.AdminPort),
+			baseID:    c.BaseID,
+			drainTime: c.DrainTime,
+		},
+		reloadTimeout: c.ReloadTimeout,
+		watch:         c.Watch,
+		ready:         ready,
+	}
+	return supervisor.run(p)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHAProxyMaster(t *testing.T) {
+	socket := path.Join(t.TempDir(), "haproxy.sock")
+	t.Setenv(fakeHAProxyEnv, socket)
+
+	var log strings.Builder
+	h := &haproxyMaster{
+		binary: os.Args[0],
+		config: "haproxy.cfg",
+		socket: socket,
+		log:    &log,
+	}
+	defer h.stop()
+
+	var workers []string
+	for i := 0; i < 3; i++ {
+		if err := h.reload(5 * time.Second); err != nil {
+			t.Fatal(err)
+		}
+		workers = append(workers, h.worker)
+	}
+
+	master := h.cmd.Process.Pid
+	for i, worker := range workers {
+		if i > 0 && worker == workers[i-1] {
+			t.Errorf("reload %d: expected a new worker, got %v", i, workers)
+		}
+	}
+	if ppid, err := parentPid(h.worker); err != nil || ppid != master {
+		t.Errorf("expected worker %s to belong to master %d, got %v, %v", h.worker, master, ppid, err)
+	}
+	if args := h.cmd.Args[1:]; strings.Join(args, " ") != "-W -f haproxy.cfg" {
+		t.Errorf("expected master-worker mode, got %v", args)
+	}
+
+	h.stop()
+	if h.cmd != nil {
+		t.Errorf("expected master %d to be stopped", master)
+	}
+	if _, err := haproxyInfo(socket); err == nil {
+		t.Error("expected no worker to answer after stopping")
+	}
+}
+
+func TestHAProxyMasterStopKills(t *testing.T) {
+	defer func(timeout time.Duration) { proxyStopTimeout = timeout }(proxyStopTimeout)
+	proxyStopTimeout = 100 * time.Millisecond
+
+	trapped := path.Join(t.TempDir(), "trapped")
+	cmd := exec.Command("/bin/sh", "-c", "trap '' TERM; touch "+trapped+"; exec sleep 60")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	h := &haproxyMaster{binary: "/bin/sh", cmd: cmd, exited: make(chan error, 1)}
+	go func() {
+		h.exited <- cmd.Wait()
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(trapped); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			_ = cmd.Process.Kill()
+			t.Fatal("master did not start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	start := time.Now()
+	stopped := make(chan struct{})
+	go func() {
+		h.stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(10 * time.Second):
+		_ = cmd.Process.Kill()
+		t.Fatal("expected a master that ignores SIGTERM to be killed")
+	}
+	if elapsed := time.Since(start); elapsed < proxyStopTimeout {
+		t.Errorf("expected the master to be given %v to exit, killed after %v", proxyStopTimeout, elapsed)
+	}
+}
+
+func TestHAProxyMasterIgnoresStaleHAProxy(t *testing.T) {
+	socket := path.Join(t.TempDir(), "haproxy.sock")
+	t.Setenv(fakeHAProxyEnv, socket)
+
+	// An HAProxy left running from an earlier run still answers
+	// on the socket while the new master starts its first worker.
+	stale := exec.Command(os.Args[0], "-f", "haproxy.cfg")
+	if err := stale.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = stale.Process.Kill()
+		_ = stale.Wait()
+	}()
+	stalePid := strconv.Itoa(stale.Process.Pid)
+	for {
+		if info, err := haproxyInfo(socket); err == nil && info["Pid"] == stalePid {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	h := &haproxyMaster{
+		binary: os.Args[0],
+		config: "haproxy.cfg",
+		socket: socket,
+		log:    io.Discard,
+	}
+	defer h.stop()
+
+	if err := h.reload(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if h.worker == stalePid {
+		t.Fatalf("expected the master's worker, got the stale HAProxy %s", stalePid)
+	}
+	if ppid, err := parentPid(h.worker); err != nil || ppid != h.cmd.Process.Pid {
+		t.Errorf("expected worker %s to belong to master %d, got %v, %v", h.worker, h.cmd.Process.Pid, ppid, err)
+	}
+}
+
+func TestLoadBenchmarkSpecServeProxy(t *testing.T) {
+	for _, tc := range []struct {
+		spec  string
+		valid bool
+	}{
+		{`{}`, true},
+		{`{"serve_proxy": "haproxy"}`, true},
+		{`{"serve_proxy": "envoy", "proxy_binary": "/usr/local/bin/envoy"}`, true},
+		{`{"serve_proxy": "nginx"}`, false},
+	} {
+		filename := path.Join(t.TempDir(), "spec.json")
+		if err := os.WriteFile(filename, []byte(tc.spec), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadBenchmarkSpec(filename); (err == nil) != tc.valid {
+			t.Errorf("%s: expected valid=%v, got %v", tc.spec, tc.valid, err)
+		}
+	}
+}
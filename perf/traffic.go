@@ -1,5 +1,11 @@
 package main
 
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
 type TrafficType string
 
 const (
@@ -9,23 +15,152 @@ const (
 	ReencryptTraffic   TrafficType = "reencrypt"
 )
 
-var AllTrafficTypes = [...]TrafficType{
-	EdgeTraffic,
-	HTTPTraffic,
-	PassthroughTraffic,
-	ReencryptTraffic,
+// PortRole is which of the proxy's ports a route is reached on and
+// whether the proxy terminates TLS for it.
+type PortRole string
+
+const (
+	// HTTPPortRole routes are plain HTTP on HTTPPort.
+	HTTPPortRole PortRole = "http"
+
+	// HTTPSPortRole routes have TLS terminated by the proxy on
+	// HTTPSPort and HTTPSPortSNIOnly.
+	HTTPSPortRole PortRole = "https"
+
+	// PassthroughPortRole routes are selected by SNI on
+	// HTTPSPort and their TLS is passed through to the backend.
+	PassthroughPortRole PortRole = "passthrough"
+)
+
+// BackendTLS is whether, and by whom, TLS is spoken to the backend.
+type BackendTLS string
+
+const (
+	// BackendPlain backends speak plain HTTP.
+	BackendPlain BackendTLS = "plain"
+
+	// BackendReencrypt backends are connected to over a new TLS
+	// connection originated by the proxy.
+	BackendReencrypt BackendTLS = "reencrypt"
+
+	// BackendPassthrough backends terminate the client's TLS.
+	BackendPassthrough BackendTLS = "passthrough"
+)
+
+// TrafficTypeSpec describes how the routes of a traffic type are
+// served by their backends and configured in each proxy.
+type TrafficTypeSpec struct {
+	Name TrafficType
+
+	// Scheme is the scheme clients use to reach the route
+	// through the proxy.
+	Scheme     string
+	PortRole   PortRole
+	BackendTLS BackendTLS
+
+	// HAProxyBackendPrefix names the route's HAProxy backend
+	// (<prefix>:<name>), and its nginx upstream.
+	HAProxyBackendPrefix string
+
+	// HAProxyMaps are the map files the route is added to; each
+	// must be one of haproxyMaps.
+	HAProxyMaps []string
+
+	// HAProxyTemplate is the backends.tmpl fragment that
+	// defines the route's HAProxy backend.
+	HAProxyTemplate string
+}
+
+var trafficTypes = map[TrafficType]*TrafficTypeSpec{}
+
+// AllTrafficTypes are the registered traffic types, in name order.
+var AllTrafficTypes []TrafficType
+
+func registerTrafficType(spec TrafficTypeSpec) {
+	if _, ok := trafficTypes[spec.Name]; ok {
+		panic("traffic type registered twice: " + spec.Name)
+	}
+	for _, mapName := range spec.HAProxyMaps {
+		if !isHAProxyMap(mapName) {
+			panic(fmt.Sprintf("traffic type %s: unknown HAProxy map %q", spec.Name, mapName))
+		}
+	}
+	trafficTypes[spec.Name] = &spec
+	AllTrafficTypes = append(AllTrafficTypes, spec.Name)
+	sort.Slice(AllTrafficTypes, func(i, j int) bool {
+		return AllTrafficTypes[i] < AllTrafficTypes[j]
+	})
+}
+
+func init() {
+	registerTrafficType(TrafficTypeSpec{
+		Name:                 EdgeTraffic,
+		Scheme:               "https",
+		PortRole:             HTTPSPortRole,
+		BackendTLS:           BackendPlain,
+		HAProxyBackendPrefix: "be_edge_http",
+		HAProxyMaps:          []string{ReencryptBackendMapName},
+		HAProxyTemplate:      "http-backend",
+	})
+	registerTrafficType(TrafficTypeSpec{
+		Name:                 HTTPTraffic,
+		Scheme:               "http",
+		PortRole:             HTTPPortRole,
+		BackendTLS:           BackendPlain,
+		HAProxyBackendPrefix: "be_http",
+		HAProxyMaps:          []string{HTTPBackendMapName},
+		HAProxyTemplate:      "http-backend",
+	})
+	registerTrafficType(TrafficTypeSpec{
+		Name:                 PassthroughTraffic,
+		Scheme:               "https",
+		PortRole:             PassthroughPortRole,
+		BackendTLS:           BackendPassthrough,
+		HAProxyBackendPrefix: "be_tcp",
+		HAProxyMaps:          []string{SNIPassthroughMapName, TCPBackendMapName},
+		HAProxyTemplate:      "tcp-backend",
+	})
+	registerTrafficType(TrafficTypeSpec{
+		Name:                 ReencryptTraffic,
+		Scheme:               "https",
+		PortRole:             HTTPSPortRole,
+		BackendTLS:           BackendReencrypt,
+		HAProxyBackendPrefix: "be_secure",
+		HAProxyMaps:          []string{ReencryptBackendMapName},
+		HAProxyTemplate:      "http-backend",
+	})
+}
+
+func lookupTrafficType(t TrafficType) (*TrafficTypeSpec, error) {
+	spec, ok := trafficTypes[t]
+	if !ok {
+		return nil, fmt.Errorf("unknown traffic type %q", t)
+	}
+	return spec, nil
+}
+
+// trafficTypesWithPortRole returns the traffic types reached on
+// role's ports.
+func trafficTypesWithPortRole(role PortRole) []TrafficType {
+	var result []TrafficType
+	for _, t := range AllTrafficTypes {
+		if trafficTypes[t].PortRole == role {
+			result = append(result, t)
+		}
+	}
+	return result
 }
 
-func mustParseTrafficType(s string) TrafficType {
-	switch s {
-	case "http":
-		return HTTPTraffic
-	case "edge":
-		return EdgeTraffic
-	case "reencrypt":
-		return ReencryptTraffic
-	case "passthrough":
-		return PassthroughTraffic
+// trafficTypeFromHostname recovers the traffic type from a hostname
+// generated by serve-backends (<prefix>-<type>-<n>). The longest
+// match wins so that a variant such as edge-h2 is not taken for
+// edge.
+func trafficTypeFromHostname(hostname string) (TrafficType, bool) {
+	var result TrafficType
+	for _, t := range AllTrafficTypes {
+		if strings.Contains(hostname, fmt.Sprintf("-%s-", t)) && len(t) > len(result) {
+			result = t
+		}
 	}
-	panic("unknown taffic type" + s)
+	return result, result != ""
 }
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"html/template"
+	"sort"
+	"testing"
+)
+
+func TestTrafficTypeRegistry(t *testing.T) {
+	if !sort.SliceIsSorted(AllTrafficTypes, func(i, j int) bool { return AllTrafficTypes[i] < AllTrafficTypes[j] }) {
+		t.Errorf("traffic types not in name order: %v", AllTrafficTypes)
+	}
+
+	for _, trafficType := range AllTrafficTypes {
+		spec, err := lookupTrafficType(trafficType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if spec.Scheme == "" || spec.PortRole == "" || spec.BackendTLS == "" || spec.HAProxyBackendPrefix == "" || spec.HAProxyTemplate == "" {
+			t.Errorf("%s: incomplete spec %+v", trafficType, spec)
+		}
+		if template.Must(template.New("backends").Parse(backendTemplate)).Lookup(spec.HAProxyTemplate) == nil {
+			t.Errorf("%s: no %q fragment in backends.tmpl", trafficType, spec.HAProxyTemplate)
+		}
+	}
+
+	if _, err := lookupTrafficType("websocket"); err == nil {
+		t.Error("expected an error for an unregistered traffic type")
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("expected a traffic type with an unknown HAProxy map to be rejected")
+			}
+			delete(trafficTypes, "websocket")
+		}()
+		registerTrafficType(TrafficTypeSpec{Name: "websocket", HAProxyMaps: []string{"os_websocket_be.map"}})
+	}()
+}
+
+func TestTrafficTypeFromHostname(t *testing.T) {
+	registerTrafficType(TrafficTypeSpec{Name: "edge-h2", PortRole: HTTPSPortRole, BackendTLS: BackendPlain})
+	defer func() {
+		delete(trafficTypes, "edge-h2")
+		for i, trafficType := range AllTrafficTypes {
+			if trafficType == "edge-h2" {
+				AllTrafficTypes = append(AllTrafficTypes[:i], AllTrafficTypes[i+1:]...)
+				break
+			}
+		}
+	}()
+
+	for hostname, expected := range map[string]TrafficType{
+		"perf-test-hydra-edge-0":    EdgeTraffic,
+		"perf-test-hydra-edge-h2-0": "edge-h2",
+		"perf-test-hydra-http-12":   HTTPTraffic,
+	} {
+		if got, ok := trafficTypeFromHostname(hostname); !ok || got != expected {
+			t.Errorf("%s: expected %v, got %v", hostname, expected, got)
+		}
+	}
+
+	if _, ok := trafficTypeFromHostname("example.com"); ok {
+		t.Error("expected no traffic type for example.com")
+	}
+}